@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returned when a request carries credentials that don't check out
+var ErrBadCredentials = errors.New("bad credentials")
+
+// A way of establishing who made a request
+type Authenticator interface {
+	// Returns the user making the request, or "" if the request carries
+	// nothing this authenticator understands
+	Authenticate(r *http.Request) (string, error)
+}
+
+type contextKey int
+
+const userKey contextKey = iota
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// Returns the authenticated user, or "" when authentication is off
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
+// Checks HTTP basic auth against bcrypt hashes from an htpasswd file, as
+// written by `htpasswd -B`
+type basicAuth struct {
+	hashes map[string][]byte
+	// bcrypt is slow by design, and browsers send the password with every
+	// request, so remember the credentials that have already been checked
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]string
+}
+
+func newBasicAuth(path string) (*basicAuth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	auth := &basicAuth{hashes: make(map[string][]byte), verified: make(map[[sha256.Size]byte]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("%s: entry for %q is not a bcrypt hash", path, user)
+		}
+		auth.hashes[user] = []byte(hash)
+	}
+	return auth, scanner.Err()
+}
+
+func (auth *basicAuth) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	key := sha256.Sum256([]byte(user + ":" + password))
+	auth.mu.Lock()
+	verified, ok := auth.verified[key]
+	auth.mu.Unlock()
+	if ok {
+		return verified, nil
+	}
+
+	hash, ok := auth.hashes[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", ErrBadCredentials
+	}
+	auth.mu.Lock()
+	auth.verified[key] = user
+	auth.mu.Unlock()
+	return user, nil
+}
+
+// Checks API tokens, sent as "Authorization: Bearer TOKEN"
+type tokenAuth struct {
+	db Db
+}
+
+// Creates a new random API token for a user, returning the token itself,
+// which is the only time it is ever seen
+func createToken(ctx context.Context, db Db, user string) (int64, string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return 0, "", err
+	}
+	token := hex.EncodeToString(secret)
+	id, err := db.AddToken(ctx, user, hashToken(token))
+	return id, token, err
+}
+
+// Tokens are long and random, so a plain hash is as good as a slow one
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Looks up the user a token belongs to
+func (auth *tokenAuth) check(ctx context.Context, token string) (string, error) {
+	user, err := auth.db.TokenUser(ctx, hashToken(token))
+	if errors.Is(err, ErrNoToken) {
+		return "", ErrBadCredentials
+	}
+	return user, err
+}
+
+func (auth *tokenAuth) Authenticate(r *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", nil
+	}
+	return auth.check(r.Context(), strings.TrimSpace(token))
+}
+
+// Believes the user name a reverse proxy puts in a header, so long as the
+// request really came from the proxy
+type proxyAuth struct {
+	header  string
+	proxies []netip.Prefix
+}
+
+func (auth *proxyAuth) Authenticate(r *http.Request) (string, error) {
+	user := r.Header.Get(auth.header)
+	if user == "" {
+		return "", nil
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return "", nil
+	}
+	for _, prefix := range auth.proxies {
+		if prefix.Contains(addrPort.Addr().Unmap()) {
+			return user, nil
+		}
+	}
+	// anyone could have set the header
+	return "", nil
+}
+
+// Settings for authentication
+type AuthConfig struct {
+	// Some of "basic", "token" and "proxy". Authentication is off when
+	// there are none.
+	Methods []string
+	// For basic, the htpasswd file
+	HtpasswdFile string
+	// For proxy, the header carrying the user name and the addresses of the
+	// proxies that set it
+	ProxyHeader    string
+	TrustedProxies []netip.Prefix
+}
+
+// Builds the authenticators for the configured methods
+func newAuthenticators(db Db, config AuthConfig) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, method := range config.Methods {
+		switch method {
+		case "basic":
+			auth, err := newBasicAuth(config.HtpasswdFile)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, auth)
+		case "token":
+			authenticators = append(authenticators, &tokenAuth{db})
+		case "proxy":
+			if config.ProxyHeader == "" || len(config.TrustedProxies) == 0 {
+				return nil, errors.New("proxy authentication needs a header and trusted proxies")
+			}
+			authenticators = append(authenticators, &proxyAuth{config.ProxyHeader, config.TrustedProxies})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
+
+// Lets a request through if any of the authenticators knows who made it,
+// with the user in its context. With no authenticators everything is let
+// through.
+func requireAuth(authenticators []Authenticator, next http.Handler) http.Handler {
+	if len(authenticators) == 0 {
+		return next
+	}
+	challenge := `Bearer realm="bookmarks"`
+	for _, auth := range authenticators {
+		if _, ok := auth.(*basicAuth); ok {
+			// so that browsers ask for a password
+			challenge = `Basic realm="bookmarks", charset="UTF-8"`
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, auth := range authenticators {
+			user, err := auth.Authenticate(r)
+			if errors.Is(err, ErrBadCredentials) {
+				break
+			}
+			if err != nil {
+				logError(w, fmt.Sprintf("Error authenticating: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if user != "" {
+				next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
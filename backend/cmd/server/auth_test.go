@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"gotest.tools/assert"
+)
+
+func writeHtpasswd(t *testing.T, user string, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NilError(t, err)
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NilError(t, os.WriteFile(path, []byte("# users\n"+user+":"+string(hash)+"\n"), 0600))
+	return path
+}
+
+// Makes a request through the full set of routes, returning the status
+func authTest(t *testing.T, handler http.Handler, path string, setup func(r *http.Request), expStatus int) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, expStatus, w.Result().StatusCode)
+	if expStatus == http.StatusUnauthorized {
+		assert.Assert(t, w.Result().Header.Get("WWW-Authenticate") != "")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	db := setupTest(t)
+	frontend := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(frontend, "assets"), 0700))
+	assert.NilError(t, os.WriteFile(filepath.Join(frontend, "assets", "app.js"), []byte("app"), 0600))
+	assert.NilError(t, os.WriteFile(filepath.Join(frontend, "index.html"), []byte("index"), 0600))
+
+	authenticators, err := newAuthenticators(db, AuthConfig{
+		Methods:        []string{"basic", "token", "proxy"},
+		HtpasswdFile:   writeHtpasswd(t, "alice", "sesame"),
+		ProxyHeader:    "X-Forwarded-User",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	assert.NilError(t, err)
+	mux := newMux(db, &mockFetcher{}, nil, frontend, "", authenticators)
+
+	// assets are public, everything else isn't
+	authTest(t, mux, "/assets/app.js", nil, http.StatusOK)
+	authTest(t, mux, "/", nil, http.StatusUnauthorized)
+	authTest(t, mux, "/api/recents", nil, http.StatusUnauthorized)
+
+	// basic auth, twice so the second time comes from the cache
+	for range 2 {
+		authTest(t, mux, "/api/recents", func(r *http.Request) { r.SetBasicAuth("alice", "sesame") }, http.StatusOK)
+	}
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized)
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.SetBasicAuth("bob", "sesame") }, http.StatusUnauthorized)
+
+	// bearer tokens
+	id, token, err := createToken(context.Background(), db, "bob")
+	assert.NilError(t, err)
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, http.StatusOK)
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized)
+	tokens, err := db.Tokens(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(tokens))
+	assert.Equal(t, "bob", tokens[0].User)
+	assert.Assert(t, tokens[0].LastUsed.Valid)
+	assert.NilError(t, db.RevokeToken(context.Background(), id))
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, http.StatusUnauthorized)
+	assert.Equal(t, ErrNoToken, db.RevokeToken(context.Background(), id))
+
+	// the proxy header only counts from the proxy
+	authTest(t, mux, "/api/recents", func(r *http.Request) { r.Header.Set("X-Forwarded-User", "carol") }, http.StatusUnauthorized)
+	authTest(t, mux, "/api/recents", func(r *http.Request) {
+		r.RemoteAddr = "10.1.2.3:1234"
+		r.Header.Set("X-Forwarded-User", "carol")
+	}, http.StatusOK)
+}
+
+func TestAuthUser(t *testing.T) {
+	var user string
+	handler := requireAuth([]Authenticator{&proxyAuth{"X-User", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user = userFrom(r.Context())
+		}))
+	authTest(t, handler, "/", func(r *http.Request) { r.Header.Set("X-User", "dave") }, http.StatusOK)
+	assert.Equal(t, "dave", user)
+
+	// with no authentication everything gets through, anonymously
+	handler = requireAuth(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = userFrom(r.Context())
+	}))
+	authTest(t, handler, "/", nil, http.StatusOK)
+	assert.Equal(t, "", user)
+
+	_, err := newAuthenticators(nil, AuthConfig{Methods: []string{"magic"}})
+	assert.ErrorContains(t, err, "unknown authentication method")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `usage: server [command]
+
+With no command, runs the server. Commands are:
+  import [-format netscape|json] [-mode merge|replace] [-user NAME] FILE
+                 import bookmarks from a browser's bookmarks.html export,
+                 or restore a JSON dump from /api/export?format=json
+  token create USER
+                 make an API token for a user, and print it
+  token list     list API tokens
+  token revoke ID
+                 delete an API token
+  user list      list users and how many bookmarks each has
+  user rename NAME NEWNAME
+                 rename a user, keeping their bookmarks and tokens
+
+Bookmarks belong to the "default" user unless another is given.`
+
+// Runs a command given on the command line instead of the server
+func runCommand(ctx context.Context, db Db, args []string) error {
+	switch args[0] {
+	case "import":
+		flags := flag.NewFlagSet("import", flag.ContinueOnError)
+		format := flags.String("format", "netscape", "netscape or json")
+		mode := flags.String("mode", "merge", "for json, whether to merge with or replace existing bookmarks")
+		user := flags.String("user", "", "whose bookmarks to import into")
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		return importCommand(withUser(ctx, *user), db, flags.Arg(0), *format, *mode)
+	case "token":
+		return tokenCommand(ctx, db, args[1:])
+	case "user":
+		return userCommand(ctx, db, args[1:])
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
+
+func importCommand(ctx context.Context, db Db, path string, format string, mode string) error {
+	restoreMode, err := parseRestoreMode(mode)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var summary importSummary
+	switch format {
+	case "netscape":
+		summary, err = importNetscape(ctx, db, file)
+	case "json":
+		summary, err = importDump(ctx, db, file, restoreMode)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	for _, msg := range summary.Errors {
+		fmt.Println("failed:", msg)
+	}
+	fmt.Println(summary)
+	return nil
+}
+
+func tokenCommand(ctx context.Context, db Db, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "create":
+		id, token, err := createToken(ctx, db, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("token %d for %s: %s\n", id, args[1], token)
+		return nil
+	case len(args) == 1 && args[0] == "list":
+		tokens, err := db.Tokens(ctx)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			lastUsed := "never"
+			if token.LastUsed.Valid {
+				lastUsed = token.LastUsed.Time.Format(time.DateTime)
+			}
+			fmt.Printf("%d\t%s\tcreated %s\tlast used %s\n", token.Id, token.User, token.Created.Format(time.DateTime), lastUsed)
+		}
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad token id %q", args[1])
+		}
+		return db.RevokeToken(ctx, id)
+	}
+	return fmt.Errorf("%s", usage)
+}
+
+func userCommand(ctx context.Context, db Db, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		users, err := db.Users(ctx)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%s\t%d bookmarks\n", user.Name, user.Bookmarks)
+		}
+		return nil
+	case len(args) == 3 && args[0] == "rename":
+		return db.RenameUser(ctx, args[1], args[2])
+	}
+	return fmt.Errorf("%s", usage)
+}
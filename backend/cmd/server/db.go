@@ -2,30 +2,124 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
 	"os"
+	"strings"
+	"sync"
+	"time"
 	"unicode"
-	"unicode/utf8"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Db interface {
 	Close()
-	Hit(ctx context.Context, url string) error
+	NormalizeUrl(url string) string
+	Hit(ctx context.Context, url string, visitor Visitor) error
+	History(ctx context.Context, req HistoryRequest) (HistoryPage, error)
+	Stats(ctx context.Context, url string) (BookmarkStats, error)
+	LinksToCheck(ctx context.Context, checkedBefore time.Time, count int) ([]LinkToCheck, error)
+	RecordCheck(ctx context.Context, link LinkToCheck, check LinkCheck, checkErr error) error
+	CheckedLinks(ctx context.Context) ([]CheckedLink, error)
+	FollowRedirects(ctx context.Context, urls []string) (int, error)
+	Duplicates(ctx context.Context) ([]DuplicateGroup, error)
+	Merge(ctx context.Context, into string, urls []string) error
+	RefreshFrecency(ctx context.Context) error
 	SetFavorite(ctx context.Context, url string, isFavorite bool) error
 	Get(ctx context.Context, url string) (BookmarkData, bool)
 	Recents(ctx context.Context, count int) (bookmarkList, error)
 	Favorites(ctx context.Context, count int) (bookmarkList, error)
 	Insert(ctx context.Context, url string, bookmark BookmarkData) error
 	Search(ctx context.Context, pattern string) (bookmarkList, error)
+	Page(ctx context.Context, req PageRequest) (Page, error)
+	Delete(ctx context.Context, url string) error
+	Update(ctx context.Context, url string, patch BookmarkPatch) error
+	AddTag(ctx context.Context, url string, tag string) error
+	RemoveTag(ctx context.Context, url string, tag string) error
+	Tags(ctx context.Context) (tagList, error)
+	Tagged(ctx context.Context, tag string, count int) (bookmarkList, error)
+	Icon(ctx context.Context, url string) (Icon, error)
+	AddPending(ctx context.Context, url string, bookmark BookmarkData, canonical bool) (Job, error)
+	ClaimJob(ctx context.Context) (Job, bool, error)
+	CompleteJob(ctx context.Context, id int64, bookmark BookmarkData) error
+	RetryJob(ctx context.Context, id int64, message string, delay time.Duration) error
+	FailJob(ctx context.Context, id int64, message string) error
+	Job(ctx context.Context, id int64) (Job, error)
+	ResetJobs(ctx context.Context) error
+	Import(ctx context.Context, bookmark ImportedBookmark) error
+	Bookmark(ctx context.Context, url string) (ExportedBookmark, error)
+	Export(ctx context.Context, fn func(ExportedBookmark) error) error
+	Posts(ctx context.Context, req PostsRequest) ([]ExportedBookmark, error)
+	LastAdded(ctx context.Context) (time.Time, error)
+	Restore(ctx context.Context, mode RestoreMode, bookmarks iter.Seq2[ExportedBookmark, error]) (int, error)
+	AddToken(ctx context.Context, user string, hash string) (int64, error)
+	TokenUser(ctx context.Context, hash string) (string, error)
+	Tokens(ctx context.Context) ([]Token, error)
+	RevokeToken(ctx context.Context, id int64) error
+	Users(ctx context.Context) ([]User, error)
+	RenameUser(ctx context.Context, name string, newName string) error
 }
 
+// Someone with bookmarks of their own
+type User struct {
+	Name      string
+	Bookmarks int
+}
+
+// An API token, without the secret part
+type Token struct {
+	Id       int64
+	User     string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+// A site icon as stored in the database
+type Icon struct {
+	Hash        string
+	ContentType string
+	Data        []byte
+}
+
+// Describes changes to be made to an existing bookmark. Nil fields are left
+// unchanged.
+type BookmarkPatch struct {
+	Title *string
+	Url   *string
+	Notes *string
+}
+
+// Returned when an operation targets a bookmark that does not exist
+var ErrNotFound = errors.New("bookmark not found")
+
+// Returned when an operation would create a second bookmark for a url
+var ErrExists = errors.New("bookmark already exists")
+
+// Returned when an API token does not exist
+var ErrNoToken = errors.New("token not found")
+
+// Returned when a tag name is empty or contains whitespace
+var ErrInvalidTag = errors.New("tag names must be non-empty and contain no whitespace")
+
 type DbContext struct {
-	db *sql.DB
+	db   *sql.DB
+	urls *UrlNormalizer
+	// user ids by name, since every request needs one
+	mu    sync.Mutex
+	users map[string]int64
 }
 
-func NewDb(dbfile string) (Db, error) {
+// The user that requests are made as when authentication is off, and who
+// owns the bookmarks from before there were users
+const defaultUser = "default"
+
+func NewDb(dbfile string, urls *UrlNormalizer) (Db, error) {
 	_, err := os.Stat(dbfile)
 	if err != nil {
 		_, err = os.Create(dbfile)
@@ -33,7 +127,10 @@ func NewDb(dbfile string) (Db, error) {
 			return nil, err
 		}
 	}
-	db, err := sql.Open("sqlite3", dbfile)
+	// The fetch queue writes from several goroutines at once. WAL lets
+	// readers carry on while that happens, and taking the write lock at the
+	// start of a transaction avoids deadlocks between would-be writers.
+	db, err := sql.Open("sqlite3", dbfile+"?_journal_mode=WAL&_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
 	}
@@ -42,12 +139,12 @@ func NewDb(dbfile string) (Db, error) {
 	row := db.QueryRow("SELECT schemaVersion FROM metadata WHERE id = 0")
 	_ = row.Scan(&schemaVersion)
 
-	err = applySchema(db, schemaVersion)
+	err = applySchema(db, schemaVersion, len(schema))
 	if err != nil {
 		return nil, err
 	}
 
-	return &DbContext{db}, nil
+	return &DbContext{db: db, urls: urls, users: make(map[string]int64)}, nil
 }
 
 func NewTestDb() (*DbContext, error) {
@@ -55,17 +152,21 @@ func NewTestDb() (*DbContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	// each connection to :memory: gets a database of its own, so there must
+	// only be the one, for the job queue's workers to see the same bookmarks
+	db.SetMaxOpenConns(1)
 
-	err = applySchema(db, 0)
+	err = applySchema(db, 0, len(schema))
 	if err != nil {
 		return nil, err
 	}
 
-	return &DbContext{db}, err
+	return &DbContext{db: db, urls: NewUrlNormalizer(nil), users: make(map[string]int64)}, err
 }
 
-func applySchema(db *sql.DB, lastVersion int) error {
-	for _, sql := range schema[lastVersion:] {
+// Brings the schema from lastVersion up to version
+func applySchema(db *sql.DB, lastVersion int, version int) error {
+	for _, sql := range schema[lastVersion:version] {
 		_, err := db.Exec(sql)
 		if err != nil {
 			return err
@@ -73,52 +174,226 @@ func applySchema(db *sql.DB, lastVersion int) error {
 	}
 	_, err := db.Exec(`INSERT INTO metadata (id, schemaVersion) VALUES (0, @version)
 						ON CONFLICT DO UPDATE SET schemaVersion = @version`,
-		sql.Named("version", len(schema)))
+		sql.Named("version", version))
 	if err != nil {
 		return err
 	}
+	if version >= urlWordsVersion {
+		return fillUrlWords(db)
+	}
 	return nil
 }
 
+// The schema version from which bookmarks have a plain urlWords column
+const urlWordsVersion = 17
+
+// Works out the words of the urls of any bookmarks written without them:
+// all of them when the column is first added, or any added to the database
+// by hand since
+func fillUrlWords(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type bookmarkUrl struct {
+		id  int64
+		url string
+	}
+	var missing []bookmarkUrl
+	rows, err := tx.Query("SELECT id, url FROM bookmarks WHERE urlWords IS NULL")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var bookmark bookmarkUrl
+		err = rows.Scan(&bookmark.id, &bookmark.url)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, bookmark)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(missing) == 0 {
+		return err
+	}
+	for _, bookmark := range missing {
+		_, err = tx.Exec("UPDATE bookmarks SET urlWords = ? WHERE id = ?", urlWords(bookmark.url), bookmark.id)
+		if err != nil {
+			return err
+		}
+	}
+	// the index was out of step with rows that had no words, so the
+	// triggers couldn't take their old entries out properly
+	_, err = tx.Exec("INSERT INTO fts(fts) VALUES('rebuild')")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (ctx *DbContext) Close() {
 	ctx.db.Close()
 }
 
-// Marks a bookmark as being frequently accessed
-func (dbctx *DbContext) Hit(ctx context.Context, url string) error {
-	_, err := dbctx.db.Exec("UPDATE bookmarks SET hitCount = hitCount + 1 WHERE url = ?", url)
+// Returns the id of the user making a request, adding them to the users
+// table the first time they are seen. Everything a user does is confined to
+// their own bookmarks.
+func (dbctx *DbContext) owner(ctx context.Context) (int64, error) {
+	name := userFrom(ctx)
+	if name == "" {
+		name = defaultUser
+	}
+	dbctx.mu.Lock()
+	id, ok := dbctx.users[name]
+	dbctx.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	row := dbctx.db.QueryRowContext(ctx, `INSERT INTO users (name, created) VALUES (?, datetime('now'))
+					ON CONFLICT (name) DO UPDATE SET name = excluded.name RETURNING id`, name)
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	dbctx.mu.Lock()
+	dbctx.users[name] = id
+	dbctx.mu.Unlock()
+	return id, nil
+}
+
+// Returns the normal form of a url, which is how new bookmarks are stored
+func (dbctx *DbContext) NormalizeUrl(url string) string {
+	return dbctx.urls.Normalize(url)
+}
+
+// Finds the id of the user's bookmark for a url, given bookmarkArgs. That is
+// the url as given or in its normal form, since bookmarks from before urls
+// were normalized may be stored either way, or failing those, a bookmark the
+// url is an alias of. The url as given wins if there is more than one.
+const bookmarkByUrl = `(SELECT id FROM (
+		SELECT id, CASE WHEN url = ? THEN 0 ELSE 1 END AS rank FROM bookmarks WHERE owner = ? AND url IN (?, ?)
+		UNION ALL SELECT bookmark, 2 FROM aliases WHERE owner = ? AND url IN (?, ?)
+	) ORDER BY rank LIMIT 1)`
+
+func (dbctx *DbContext) bookmarkArgs(owner int64, url string) []any {
+	normal := dbctx.urls.Normalize(url)
+	return []any{url, owner, url, normal, owner, url, normal}
+}
+
+// What opened a bookmark, as far as is known
+type Visitor struct {
+	// Whatever the client says it is
+	Client    string
+	UserAgent string
+}
+
+// Marks a bookmark as being frequently accessed, recording the visit
+func (dbctx *DbContext) Hit(ctx context.Context, url string, visitor Visitor) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	row := tx.QueryRowContext(ctx, "UPDATE bookmarks SET hitCount = hitCount + 1 WHERE id = "+bookmarkByUrl+" RETURNING id",
+		dbctx.bookmarkArgs(owner, url)...)
+	err = row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO visits (bookmark, visited, client, userAgent) VALUES (?, datetime('now'), nullif(?, ''), nullif(?, ''))",
+		id, visitor.Client, visitor.UserAgent)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE bookmarks SET frecency = (SELECT score FROM frecency_scores WHERE bookmark = id) WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Works out every bookmark's frecency afresh. Visits only change the score
+// of the bookmark visited, so this needs doing now and then as the other
+// visits age.
+func (dbctx *DbContext) RefreshFrecency(ctx context.Context) error {
+	_, err := dbctx.db.ExecContext(ctx, "UPDATE bookmarks SET frecency = (SELECT score FROM frecency_scores WHERE bookmark = bookmarks.id)")
 	return err
 }
 
 // Marks a bookmark as being a favorite, or not
 func (dbctx *DbContext) SetFavorite(ctx context.Context, url string, isFavorite bool) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
 	favorite := 0
 	if isFavorite {
 		favorite = 1
 	}
-	_, err := dbctx.db.ExecContext(ctx, "UPDATE bookmarks SET favorite = ? WHERE url = ?", favorite, url)
+	_, err = dbctx.db.ExecContext(ctx, "UPDATE bookmarks SET favorite = ? WHERE id = "+bookmarkByUrl,
+		append([]any{favorite}, dbctx.bookmarkArgs(owner, url)...)...)
 	return err
 }
 
-// Returns a bookmark title if one exists in the database
+// Returns a bookmark title and notes if one exists in the database
 func (dbctx *DbContext) Get(ctx context.Context, url string) (BookmarkData, bool) {
-	row := dbctx.db.QueryRowContext(ctx, "SELECT title FROM bookmarks WHERE url = ?", url)
-	var title string
-	err := row.Scan(&title)
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return BookmarkData{}, false
+	}
+	row := dbctx.db.QueryRowContext(ctx, "SELECT id, title, notes FROM bookmarks WHERE id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...)
+	var id int64
+	var bookmark BookmarkData
+	err = row.Scan(&id, &bookmark.Title, &bookmark.Notes)
 	if err != nil {
 		return BookmarkData{}, false
 	}
-	_, _ = dbctx.db.Exec("UPDATE bookmarks SET lastAccess = datetime('now') WHERE url = ?", url)
-	return BookmarkData{Title: title}, true
+	_, _ = dbctx.db.ExecContext(ctx, "UPDATE bookmarks SET lastAccess = datetime('now') WHERE id = ?", id)
+	return bookmark, true
 }
 
+// The columns read by scanBookmarkList, from the bookmarks table aliased as b
+const bookmarkColumns = "b.title, b.url, b.favorite, b.tags, b.notes, b.description, b.canonicalUrl, b.siteName, b.imageUrl, b.author, b.status"
+
+// Relative weights of the fts columns (url, title, favorite, tags, notes,
+// urlWords) when ranking search results, so that title matches rank above
+// note matches, and words in the url count for less than words in the title.
+// Better matches are more negative, and frecency makes them up to twice as
+// good.
+const searchRank = "bm25(fts, 0.0, 10.0, 0.0, 5.0, 1.0, 2.0) * (1 + b.frecency / (b.frecency + 1000))"
+
 func scanBookmarkList(rows *sql.Rows) (bookmarkList, error) {
+	return scanBookmarks(rows, false)
+}
+
+// Scans bookmarks, followed by the highlightColumns, the sort key and the
+// id for a page of them
+func scanBookmarks(rows *sql.Rows, paged bool) (bookmarkList, error) {
 	var result bookmarkList
 
 	for rows.Next() {
 		var r bookmarkEntry
 		var favorite int
-		err := rows.Scan(&r.Title, &r.Url, &favorite)
+		var tags string
+		dest := []any{&r.Title, &r.Url, &favorite, &tags, &r.Notes,
+			&r.Description, &r.CanonicalUrl, &r.SiteName, &r.ImageUrl, &r.Author, &r.Status}
+		var title, snippet sql.NullString
+		if paged {
+			dest = append(dest, &title, &snippet, &r.sortKey, &r.id)
+		}
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, err
 		}
@@ -127,6 +402,13 @@ func scanBookmarkList(rows *sql.Rows) (bookmarkList, error) {
 		} else {
 			r.IsFavorite = false
 		}
+		r.Tags = strings.Fields(tags)
+		if title.Valid {
+			r.TitleHighlight = parseHighlight(title.String)
+		}
+		if snippet.Valid && r.Notes != "" {
+			r.Snippet = parseHighlight(snippet.String)
+		}
 		result = append(result, r)
 	}
 	return result, nil
@@ -134,45 +416,1417 @@ func scanBookmarkList(rows *sql.Rows) (bookmarkList, error) {
 
 // Returns the most recently-accessed bookmarks
 func (dbctx *DbContext) Recents(ctx context.Context, count int) (bookmarkList, error) {
-	rows, err := dbctx.db.QueryContext(ctx, `SELECT title, url, favorite FROM bookmarks WHERE title != '""' ORDER BY lastAccess DESC LIMIT ?`, count)
+	page, err := dbctx.Page(ctx, PageRequest{Titled: true, Sort: SortRecent, Count: count})
+	return page.Items, err
+}
+
+// Returns the most used favorites
+func (dbctx *DbContext) Favorites(ctx context.Context, count int) (bookmarkList, error) {
+	page, err := dbctx.Page(ctx, PageRequest{Favorites: true, Titled: true, Sort: SortFrecency, Count: count})
+	return page.Items, err
+}
+
+// Returns a page of bookmarks. Malformed queries give a *QueryError, and
+// cursors from a different listing ErrInvalidCursor.
+func (dbctx *DbContext) Page(ctx context.Context, req PageRequest) (Page, error) {
+	page := Page{Items: bookmarkList{}}
+	query, err := parseQuery(req.Query)
 	if err != nil {
-		return nil, err
+		return page, err
+	}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return page, err
+	}
+
+	columns := bookmarkColumns + ", NULL, NULL"
+	from := "bookmarks b"
+	where := []string{"b.owner = ?"}
+	args := []any{owner}
+	sort := req.Sort
+	if match := query.match(); match != "" {
+		columns = bookmarkColumns + ", " + highlightColumns
+		from = "fts JOIN bookmarks b ON b.id = fts.rowid"
+		where = append(where, "fts MATCH ?")
+		args = append(args, match)
+	} else if sort == SortRelevance {
+		sort = SortRecent
+	}
+	if excluded := query.excluded(); excluded != "" {
+		where = append(where, "b.id NOT IN (SELECT rowid FROM fts WHERE fts MATCH ?)")
+		args = append(args, excluded)
+	}
+	for _, filter := range query.filters {
+		where = append(where, filter.where)
+		args = append(args, filter.args...)
+	}
+	if req.Favorites {
+		where = append(where, "b.favorite = 1")
+	}
+	if req.Titled {
+		where = append(where, `b.title != '""'`)
+	}
+
+	row := dbctx.db.QueryRowContext(ctx, "SELECT count(*) FROM "+from+" WHERE "+strings.Join(where, " AND "), args...)
+	err = row.Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+
+	order, ok := sortKeys[sort]
+	if !ok {
+		return page, fmt.Errorf("unknown sort %q", sort)
+	}
+	direction, after := "ASC", ">"
+	if order.desc {
+		direction, after = "DESC", "<"
+	}
+	if req.Cursor != "" && sort == SortRelevance {
+		return page, ErrUnpagedSort
+	}
+	if req.Cursor != "" {
+		cursor, err := decodeCursor(req.Cursor, sort)
+		if err != nil {
+			return page, err
+		}
+		where = append(where, "("+order.key+", b.id) "+after+" (?, ?)")
+		args = append(args, cursor.Key, cursor.Id)
+	}
+	// one more than asked for, to see if there is another page
+	limit := req.Count
+	if limit >= 0 {
+		limit++
+	}
+	args = append(args, limit)
+
+	rows, err := dbctx.db.QueryContext(ctx, "SELECT "+columns+", "+order.key+", b.id FROM "+from+
+		" WHERE "+strings.Join(where, " AND ")+
+		" ORDER BY "+order.key+" "+direction+", b.id "+direction+" LIMIT ?", args...)
+	if err != nil {
+		return page, err
 	}
 	defer rows.Close()
-	return scanBookmarkList(rows)
+	items, err := scanBookmarks(rows, true)
+	if err != nil {
+		return page, err
+	}
+	if req.Count > 0 && len(items) > req.Count {
+		items = items[:req.Count]
+		if sort != SortRelevance {
+			last := items[len(items)-1]
+			page.NextCursor = pageCursor{sort, last.sortKey, last.id}.encode()
+		}
+	}
+	if req.Count == 0 {
+		items = nil
+	}
+	if items != nil {
+		page.Items = items
+	}
+	return page, nil
 }
 
-// Returns the most frequently-accessed bookmarks
-func (dbctx *DbContext) Favorites(ctx context.Context, count int) (bookmarkList, error) {
-	rows, err := dbctx.db.QueryContext(ctx, `SELECT title, url, favorite FROM bookmarks WHERE title != '""' AND favorite = 1 ORDER BY hitCount DESC LIMIT ?`, count)
+// Reports whether an error is due to a duplicate key
+func isDuplicateKey(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
+
+// Stores a bookmark's icon, if it has one, returning the hash to refer to
+// it by
+func storeIcon(ctx context.Context, tx *sql.Tx, bookmark BookmarkData) (*string, error) {
+	if len(bookmark.Icon) == 0 {
+		return nil, nil
+	}
+	sum := sha256.Sum256(bookmark.Icon)
+	hash := hex.EncodeToString(sum[:])
+	_, err := tx.ExecContext(ctx, "INSERT INTO icons (hash, contentType, data) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", hash, bookmark.IconType, bookmark.Icon)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	return scanBookmarkList(rows)
+	return &hash, nil
 }
 
 // Insert the bookmark title corresponding to the url into the database
 func (dbctx *DbContext) Insert(ctx context.Context, url string, bookmark BookmarkData) error {
-	_, err := dbctx.db.ExecContext(ctx, "INSERT INTO bookmarks (url, title, lastAccess, hitCount) VALUES (?, ?, datetime('now'), 0)", url, bookmark.Title)
-	return err
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	iconHash, err := storeIcon(ctx, tx, bookmark)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO bookmarks (owner, url, urlWords, title, notes, icon, description, canonicalUrl, siteName, imageUrl, author, added, lastAccess, hitCount)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'), 0)`,
+		owner, url, urlWords(url), bookmark.Title, bookmark.Notes, iconHash,
+		bookmark.Description, bookmark.CanonicalUrl, bookmark.SiteName, bookmark.ImageUrl, bookmark.Author)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the icon stored for a bookmark
+func (dbctx *DbContext) Icon(ctx context.Context, url string) (Icon, error) {
+	var icon Icon
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return icon, err
+	}
+	row := dbctx.db.QueryRowContext(ctx, "SELECT i.hash, i.contentType, i.data FROM bookmarks b JOIN icons i ON i.hash = b.icon WHERE b.id = "+bookmarkByUrl,
+		dbctx.bookmarkArgs(owner, url)...)
+	err = row.Scan(&icon.Hash, &icon.ContentType, &icon.Data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return icon, ErrNotFound
+	}
+	return icon, err
 }
 
-// Search for bookmarks matching a pattern
+// Search for bookmarks matching a query, as understood by parseQuery,
+// best match first. Malformed queries give a *QueryError.
 func (dbctx *DbContext) Search(ctx context.Context, pattern string) (bookmarkList, error) {
-	if pattern == "" {
+	query, err := parseQuery(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if query.empty() {
 		return nil, nil
 	}
-	// If the final token in the pattern is a letter, add a star to treat it as
-	// a prefix query
-	lastRune, _ := utf8.DecodeLastRuneInString(pattern)
-	if unicode.IsLetter(lastRune) {
-		pattern += "*"
+	page, err := dbctx.Page(ctx, PageRequest{Query: pattern, Sort: SortRelevance, Count: -1})
+	return page.Items, err
+}
+
+// Remove a bookmark from the database
+func (dbctx *DbContext) Delete(ctx context.Context, url string) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := dbctx.db.ExecContext(ctx, "DELETE FROM bookmarks WHERE id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Change the title and/or url of an existing bookmark. Other state such as
+// hit count and favorite status stays with the bookmark.
+func (dbctx *DbContext) Update(ctx context.Context, url string, patch BookmarkPatch) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	var sets []string
+	var args []any
+	if patch.Title != nil {
+		sets = append(sets, "title = ?")
+		args = append(args, *patch.Title)
+	}
+	if patch.Url != nil {
+		sets = append(sets, "url = ?", "urlWords = ?")
+		args = append(args, *patch.Url, urlWords(*patch.Url))
+	}
+	if patch.Notes != nil {
+		sets = append(sets, "notes = ?")
+		args = append(args, *patch.Notes)
+	}
+	if len(sets) == 0 {
+		// nothing to change, but still report missing bookmarks
+		sets = append(sets, "url = url")
+	}
+	args = append(args, dbctx.bookmarkArgs(owner, url)...)
+	result, err := dbctx.db.ExecContext(ctx, "UPDATE bookmarks SET "+strings.Join(sets, ", ")+" WHERE id = "+bookmarkByUrl, args...)
+	if isDuplicateKey(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Tag names are case-insensitive and may not contain whitespace, since they
+// are stored space-separated for full-text indexing
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// Apply a tag to a bookmark
+func (dbctx *DbContext) AddTag(ctx context.Context, url string, tag string) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = dbctx.tagBookmark(ctx, tx, owner, url, tag)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dbctx *DbContext) tagBookmark(ctx context.Context, tx *sql.Tx, owner int64, url string, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM bookmarks WHERE id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON CONFLICT DO NOTHING", tag)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO bookmark_tags (bookmark, tag) SELECT ?, id FROM tags WHERE name = ? ON CONFLICT DO NOTHING", id, tag)
+	return err
+}
+
+// Remove a tag from a bookmark
+func (dbctx *DbContext) RemoveTag(ctx context.Context, url string, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := dbctx.db.ExecContext(ctx, `DELETE FROM bookmark_tags
+					WHERE bookmark = `+bookmarkByUrl+`
+					AND tag = (SELECT id FROM tags WHERE name = ?)`, append(dbctx.bookmarkArgs(owner, url), tag)...)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Returns every tag in use along with the number of bookmarks carrying it
+func (dbctx *DbContext) Tags(ctx context.Context) (tagList, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT t.name, count(*) FROM tags t
+					JOIN bookmark_tags bt ON bt.tag = t.id
+					JOIN bookmarks b ON b.id = bt.bookmark
+					WHERE b.owner = ? GROUP BY t.id ORDER BY t.name`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := tagList{}
+	for rows.Next() {
+		var r tagEntry
+		err := rows.Scan(&r.Name, &r.Count)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Returns the most recently-accessed bookmarks carrying a tag
+func (dbctx *DbContext) Tagged(ctx context.Context, tag string, count int) (bookmarkList, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return nil, err
 	}
-	rows, err := dbctx.db.QueryContext(ctx, "SELECT title, url, favorite FROM fts where fts MATCH ? ORDER BY rank", pattern)
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT `+bookmarkColumns+` FROM bookmarks b WHERE b.owner = ? AND b.id IN (
+						SELECT bt.bookmark FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE t.name = ?
+					) ORDER BY b.lastAccess DESC LIMIT ?`, owner, tag, count)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	return scanBookmarkList(rows)
 }
+
+// Selects the columns read by scanJob
+const jobSelect = `SELECT j.id, b.url, j.state, j.attempts, j.lastError, j.nextAttempt, j.created, j.updated
+	FROM jobs j JOIN bookmarks b ON b.id = j.bookmark`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (Job, error) {
+	var job Job
+	err := row.Scan(&job.Id, &job.Url, &job.State, &job.Attempts, &job.LastError, &job.NextAttempt, &job.Created, &job.Updated)
+	return job, err
+}
+
+// Stores a bookmark that is yet to be fetched, and queues a job to fetch it.
+// With canonical, the bookmark moves to the page's canonical url once that
+// is known.
+func (dbctx *DbContext) AddPending(ctx context.Context, url string, bookmark BookmarkData, canonical bool) (Job, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return Job{}, err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO bookmarks (owner, url, urlWords, title, notes, status, added, lastAccess, hitCount)
+					VALUES (?, ?, ?, '', ?, 'pending', datetime('now'), datetime('now'), 0)`, owner, url, urlWords(url), bookmark.Notes)
+	if isDuplicateKey(err) {
+		return Job{}, ErrExists
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Job{}, err
+	}
+	jobId, err := queueJob(ctx, tx, id)
+	if err != nil {
+		return Job{}, err
+	}
+	if canonical {
+		_, err = tx.ExecContext(ctx, "UPDATE jobs SET canonical = 1 WHERE id = ?", jobId)
+		if err != nil {
+			return Job{}, err
+		}
+	}
+	job, err := scanJob(tx.QueryRowContext(ctx, jobSelect+" WHERE j.id = ?", jobId))
+	if err != nil {
+		return Job{}, err
+	}
+	return job, tx.Commit()
+}
+
+// Queues a job to fetch a bookmark, returning its id
+func queueJob(ctx context.Context, tx *sql.Tx, bookmark int64) (int64, error) {
+	result, err := tx.ExecContext(ctx, `INSERT INTO jobs (bookmark, state, attempts, nextAttempt, lastError, created, updated)
+					VALUES (?, 'queued', 0, datetime('now'), '', datetime('now'), datetime('now'))`, bookmark)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Marks the next job that is ready to run as running and returns it, or
+// returns false if none is ready
+func (dbctx *DbContext) ClaimJob(ctx context.Context) (Job, bool, error) {
+	var id int64
+	row := dbctx.db.QueryRowContext(ctx, `UPDATE jobs SET state = 'running', attempts = attempts + 1, updated = datetime('now')
+					WHERE id = (
+						SELECT id FROM jobs WHERE state = 'queued' AND nextAttempt <= datetime('now')
+						ORDER BY nextAttempt LIMIT 1
+					) RETURNING id`)
+	err := row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	// the job now belongs to this worker, so it can be read separately
+	job, err := scanJob(dbctx.db.QueryRowContext(ctx, jobSelect+" WHERE j.id = ?", id))
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+// Fills in a pending bookmark with what was fetched and retires its job. A
+// title the user has supplied in the meantime is kept. If the job asked for
+// it, the bookmark moves to the page's canonical url, keeping the one it was
+// added as for an alias, or if the user already has a bookmark there, it is
+// merged into that one.
+func (dbctx *DbContext) CompleteJob(ctx context.Context, id int64, bookmark BookmarkData) error {
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	iconHash, err := storeIcon(ctx, tx, bookmark)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE bookmarks SET
+					title = CASE WHEN title = '' THEN ? ELSE title END,
+					icon = ?, description = ?, canonicalUrl = ?, siteName = ?, imageUrl = ?, author = ?,
+					status = 'ok'
+					WHERE id = (SELECT bookmark FROM jobs WHERE id = ?)`,
+		bookmark.Title, iconHash,
+		bookmark.Description, bookmark.CanonicalUrl, bookmark.SiteName, bookmark.ImageUrl, bookmark.Author,
+		id)
+	if err != nil {
+		return err
+	}
+	err = dbctx.moveToCanonical(ctx, tx, id, bookmark)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE jobs SET state = 'done', lastError = '', updated = datetime('now') WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Moves the bookmark a job fetched to the page's canonical url, if the job
+// asked for that
+func (dbctx *DbContext) moveToCanonical(ctx context.Context, tx *sql.Tx, jobId int64, bookmark BookmarkData) error {
+	var canonical bool
+	var id, owner int64
+	var url string
+	row := tx.QueryRowContext(ctx, "SELECT j.canonical, b.id, b.owner, b.url FROM jobs j JOIN bookmarks b ON b.id = j.bookmark WHERE j.id = ?", jobId)
+	err := row.Scan(&canonical, &id, &owner, &url)
+	if err != nil {
+		return err
+	}
+	target := bookmark.preferredUrl()
+	if !canonical || target == "" {
+		return nil
+	}
+	target = dbctx.urls.Normalize(target)
+	if target == url {
+		return nil
+	}
+
+	var existing int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM bookmarks WHERE id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, target)...).Scan(&existing)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = addAlias(ctx, tx, owner, id, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE bookmarks SET url = ?, urlWords = ? WHERE id = ?", target, urlWords(target), id)
+		return err
+	}
+	if err != nil || existing == id {
+		return err
+	}
+	// the job carries on with the bookmark it now belongs to, so that whoever
+	// is waiting on it sees it finish
+	_, err = tx.ExecContext(ctx, "UPDATE jobs SET bookmark = ? WHERE id = ?", existing, jobId)
+	if err != nil {
+		return err
+	}
+	return mergeInto(ctx, tx, owner, existing, id)
+}
+
+// Puts a job back in the queue to be run again after a delay
+func (dbctx *DbContext) RetryJob(ctx context.Context, id int64, message string, delay time.Duration) error {
+	_, err := dbctx.db.ExecContext(ctx, `UPDATE jobs SET state = 'queued', lastError = ?, nextAttempt = datetime('now', ?), updated = datetime('now')
+					WHERE id = ?`, message, fmt.Sprintf("+%d seconds", int(delay.Seconds())), id)
+	return err
+}
+
+// Gives up on a job, leaving its bookmark marked as failed
+func (dbctx *DbContext) FailJob(ctx context.Context, id int64, message string) error {
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE jobs SET state = 'failed', lastError = ?, updated = datetime('now') WHERE id = ?", message, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE bookmarks SET status = 'failed' WHERE id = (SELECT bookmark FROM jobs WHERE id = ?)", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns a job by id, so long as its bookmark belongs to the user
+func (dbctx *DbContext) Job(ctx context.Context, id int64) (Job, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return Job{}, err
+	}
+	row := dbctx.db.QueryRowContext(ctx, jobSelect+" WHERE j.id = ? AND b.owner = ?", id, owner)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, ErrNotFound
+	}
+	return job, err
+}
+
+// Requeues jobs that were interrupted by the server stopping, and forgets
+// about ones that finished long ago
+func (dbctx *DbContext) ResetJobs(ctx context.Context) error {
+	_, err := dbctx.db.ExecContext(ctx, "UPDATE jobs SET state = 'queued' WHERE state = 'running'")
+	if err != nil {
+		return err
+	}
+	_, err = dbctx.db.ExecContext(ctx, "DELETE FROM jobs WHERE state IN ('done', 'failed') AND updated < datetime('now', '-7 days')")
+	return err
+}
+
+// The format sqlite's datetime() produces, for storing times from elsewhere
+const sqliteTime = "2006-01-02 15:04:05"
+
+// Insert a bookmark from another source, complete with its tags and the
+// times it was added and last accessed
+func (dbctx *DbContext) Import(ctx context.Context, bookmark ImportedBookmark) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	iconHash, err := storeIcon(ctx, tx, bookmark.BookmarkData)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO bookmarks (owner, url, urlWords, title, notes, icon, description, canonicalUrl, siteName, imageUrl, author, added, lastAccess, hitCount)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		owner, bookmark.Url, urlWords(bookmark.Url), bookmark.Title, bookmark.Notes, iconHash,
+		bookmark.Description, bookmark.CanonicalUrl, bookmark.SiteName, bookmark.ImageUrl, bookmark.Author,
+		bookmark.Added.UTC().Format(sqliteTime), bookmark.LastAccess.UTC().Format(sqliteTime))
+	if isDuplicateKey(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range bookmark.Tags {
+		err = dbctx.tagBookmark(ctx, tx, owner, bookmark.Url, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The columns read by scanExportedBookmark
+const exportColumns = exportedColumns + `, ` + visitsColumn + `, ` + aliasesColumn + `, i.contentType, i.data
+	FROM bookmarks b LEFT JOIN icons i ON i.hash = b.icon`
+
+// The columns read by scanExportedBookmark, leaving out the visits, aliases
+// and icon, which are by far the biggest parts of a bookmark
+const postColumns = exportedColumns + `, NULL, NULL, NULL, NULL FROM bookmarks b`
+
+// A bookmark's visits as a JSON array, oldest first, so that they can be
+// read along with the bookmark
+const visitsColumn = `(SELECT json_group_array(json_object('visited', visited, 'client', client, 'userAgent', userAgent))
+	FROM (SELECT v.visited, ifnull(v.client, '') AS client, ifnull(v.userAgent, '') AS userAgent
+		FROM visits v WHERE v.bookmark = b.id ORDER BY v.visited, v.id))`
+
+// A bookmark's aliases as a JSON array
+const aliasesColumn = `(SELECT json_group_array(url) FROM (SELECT a.url FROM aliases a WHERE a.bookmark = b.id ORDER BY a.url))`
+
+const exportedColumns = `b.url, b.title, b.notes, b.tags, b.favorite, b.hitCount, b.added, b.lastAccess,
+	b.description, b.canonicalUrl, b.siteName, b.imageUrl, b.author, b.status`
+
+// When a bookmark was added, or failing that last opened, as postTime has it
+const postTimeColumn = "julianday(ifnull(b.added, b.lastAccess))"
+
+func scanExportedBookmark(row scanner) (ExportedBookmark, error) {
+	var bookmark ExportedBookmark
+	var tags string
+	var favorite int
+	var added, lastAccess sql.NullTime
+	var visits, aliases, iconType sql.NullString
+	err := row.Scan(&bookmark.Url, &bookmark.Title, &bookmark.Notes, &tags, &favorite, &bookmark.HitCount, &added, &lastAccess,
+		&bookmark.Description, &bookmark.CanonicalUrl, &bookmark.SiteName, &bookmark.ImageUrl, &bookmark.Author, &bookmark.Status,
+		&visits, &aliases, &iconType, &bookmark.Icon)
+	if err != nil {
+		return bookmark, err
+	}
+	if visits.Valid {
+		bookmark.Visits, err = parseVisits(visits.String)
+		if err != nil {
+			return bookmark, err
+		}
+	}
+	if aliases.Valid {
+		err = json.Unmarshal([]byte(aliases.String), &bookmark.Aliases)
+		if err != nil {
+			return bookmark, err
+		}
+	}
+	bookmark.Tags = strings.Fields(tags)
+	bookmark.IsFavorite = favorite == 1
+	bookmark.Added = added.Time
+	bookmark.LastAccess = lastAccess.Time
+	bookmark.IconType = iconType.String
+	return bookmark, nil
+}
+
+// Reads the JSON array of visitsColumn
+func parseVisits(visits string) ([]ExportedVisit, error) {
+	var rows []struct {
+		Visited   string `json:"visited"`
+		Client    string `json:"client"`
+		UserAgent string `json:"userAgent"`
+	}
+	err := json.Unmarshal([]byte(visits), &rows)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ExportedVisit, len(rows))
+	for i, row := range rows {
+		visited, err := time.Parse(sqliteTime, row.Visited)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = ExportedVisit{visited, row.Client, row.UserAgent}
+	}
+	return result, nil
+}
+
+// Returns everything stored about one bookmark. Unlike Get, this doesn't
+// count as an access.
+func (dbctx *DbContext) Bookmark(ctx context.Context, url string) (ExportedBookmark, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return ExportedBookmark{}, err
+	}
+	row := dbctx.db.QueryRowContext(ctx, "SELECT "+exportColumns+" WHERE b.id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...)
+	bookmark, err := scanExportedBookmark(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return bookmark, ErrNotFound
+	}
+	return bookmark, err
+}
+
+// Returns the user's bookmarks that a request for posts asks for, newest
+// first, without their icons
+func (dbctx *DbContext) Posts(ctx context.Context, req PostsRequest) ([]ExportedBookmark, error) {
+	var posts []ExportedBookmark
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return posts, err
+	}
+	where := []string{"b.owner = ?"}
+	args := []any{owner}
+	for _, tag := range req.Tags {
+		where = append(where, `b.id IN (SELECT bt.bookmark FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE t.name = ?)`)
+		args = append(args, tag)
+	}
+	if !req.From.IsZero() {
+		where = append(where, postTimeColumn+" >= julianday(?)")
+		args = append(args, req.From.UTC().Format(sqliteTime))
+	}
+	if !req.To.IsZero() {
+		where = append(where, postTimeColumn+" <= julianday(?)")
+		args = append(args, req.To.UTC().Format(sqliteTime))
+	}
+	// a negative limit is no limit at all
+	args = append(args, req.Count, req.Start)
+	rows, err := dbctx.db.QueryContext(ctx, "SELECT "+postColumns+" WHERE "+strings.Join(where, " AND ")+
+		" ORDER BY "+postTimeColumn+" DESC, b.id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return posts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		bookmark, err := scanExportedBookmark(rows)
+		if err != nil {
+			return posts, err
+		}
+		posts = append(posts, bookmark)
+	}
+	return posts, rows.Err()
+}
+
+// Returns when the user's newest bookmark was added, or the zero time if
+// they have none
+func (dbctx *DbContext) LastAdded(ctx context.Context) (time.Time, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest sql.NullString
+	err = dbctx.db.QueryRowContext(ctx, "SELECT datetime(max("+postTimeColumn+")) FROM bookmarks b WHERE b.owner = ?", owner).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return time.Time{}, err
+	}
+	return time.Parse(sqliteTime, latest.String)
+}
+
+// Calls fn with each of the user's bookmarks in turn, favorites first and otherwise in
+// the order they were added. Rows are read as fn goes, so that an export
+// never has the whole collection in memory at once.
+func (dbctx *DbContext) Export(ctx context.Context, fn func(ExportedBookmark) error) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	rows, err := dbctx.db.QueryContext(ctx, "SELECT "+exportColumns+" WHERE b.owner = ? ORDER BY b.favorite DESC, b.added, b.id", owner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bookmark, err := scanExportedBookmark(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(bookmark)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns a page of the user's visits to their bookmarks, most recent first
+func (dbctx *DbContext) History(ctx context.Context, req HistoryRequest) (HistoryPage, error) {
+	page := HistoryPage{Items: []Visit{}}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return page, err
+	}
+	where := []string{"b.owner = ?"}
+	args := []any{owner}
+	if !req.From.IsZero() {
+		where = append(where, "v.visited >= ?")
+		args = append(args, req.From.UTC().Format(sqliteTime))
+	}
+	if !req.To.IsZero() {
+		where = append(where, "v.visited < ?")
+		args = append(args, req.To.UTC().Format(sqliteTime))
+	}
+	from := " FROM visits v JOIN bookmarks b ON b.id = v.bookmark WHERE "
+
+	row := dbctx.db.QueryRowContext(ctx, "SELECT count(*)"+from+strings.Join(where, " AND "), args...)
+	err = row.Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+
+	if req.Cursor != "" {
+		cursor, err := decodeCursor(req.Cursor, historyOrder)
+		if err != nil {
+			return page, err
+		}
+		where = append(where, "(v.visited, v.id) < (?, ?)")
+		args = append(args, cursor.Key, cursor.Id)
+	}
+	args = append(args, req.Count+1)
+	rows, err := dbctx.db.QueryContext(ctx, "SELECT v.id, b.url, b.title, v.visited, ifnull(v.client, ''), ifnull(v.userAgent, '')"+from+
+		strings.Join(where, " AND ")+" ORDER BY v.visited DESC, v.id DESC LIMIT ?", args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var visit Visit
+		err = rows.Scan(&visit.id, &visit.Url, &visit.Title, &visit.Visited, &visit.Client, &visit.UserAgent)
+		if err != nil {
+			return page, err
+		}
+		page.Items = append(page.Items, visit)
+	}
+	if req.Count == 0 {
+		page.Items = []Visit{}
+	} else if len(page.Items) > req.Count {
+		page.Items = page.Items[:req.Count]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = pageCursor{historyOrder, last.Visited.UTC().Format(sqliteTime), last.id}.encode()
+	}
+	return page, rows.Err()
+}
+
+// Returns how a bookmark has been used
+func (dbctx *DbContext) Stats(ctx context.Context, url string) (BookmarkStats, error) {
+	stats := BookmarkStats{Url: url, Weeks: []WeekVisits{}}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return stats, err
+	}
+	var id int64
+	var added sql.NullTime
+	var lastVisited sql.NullString
+	row := dbctx.db.QueryRowContext(ctx, `SELECT b.id, b.url, b.added, ifnull(b.hitCount, 0), (SELECT max(visited) FROM visits WHERE bookmark = b.id)
+					FROM bookmarks b WHERE b.id = `+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...)
+	err = row.Scan(&id, &stats.Url, &added, &stats.VisitCount, &lastVisited)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stats, ErrNotFound
+	}
+	if err != nil {
+		return stats, err
+	}
+	stats.Added = added.Time
+	if lastVisited.Valid {
+		visited, err := time.Parse(sqliteTime, lastVisited.String)
+		if err != nil {
+			return stats, err
+		}
+		stats.LastVisited = &visited
+	}
+
+	// weeks start on Monday, which is six days before the Sunday on or after
+	// the visit
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT date(visited, 'weekday 0', '-6 days') AS week, count(*) FROM visits
+					WHERE bookmark = ? GROUP BY week ORDER BY week`, id)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var week WeekVisits
+		err = rows.Scan(&week.Week, &week.Visits)
+		if err != nil {
+			return stats, err
+		}
+		stats.Weeks = append(stats.Weeks, week)
+	}
+	return stats, rows.Err()
+}
+
+// Returns bookmarks, whoever they belong to, whose urls haven't been checked
+// since before the given time, those never checked at all first
+func (dbctx *DbContext) LinksToCheck(ctx context.Context, checkedBefore time.Time, count int) ([]LinkToCheck, error) {
+	links := []LinkToCheck{}
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT b.id, b.url FROM bookmarks b LEFT JOIN link_checks c ON c.bookmark = b.id
+					WHERE c.checked IS NULL OR c.checked < ?
+					ORDER BY c.checked IS NOT NULL, c.checked, b.id LIMIT ?`,
+		checkedBefore.UTC().Format(sqliteTime), count)
+	if err != nil {
+		return links, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var link LinkToCheck
+		err = rows.Scan(&link.Id, &link.Url)
+		if err != nil {
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Records what came of checking a bookmark's url, with checkErr saying why
+// there was no response if there wasn't one. Nothing is recorded if the
+// bookmark has gone or moved to another url in the meantime.
+func (dbctx *DbContext) RecordCheck(ctx context.Context, link LinkToCheck, check LinkCheck, checkErr error) error {
+	var message any
+	if checkErr != nil {
+		check = LinkCheck{}
+		message = checkErr.Error()
+	}
+	_, err := dbctx.db.ExecContext(ctx, `INSERT OR REPLACE INTO link_checks (bookmark, checked, status, error, redirectUrl, permanent)
+					SELECT id, datetime('now'), ?, ?, nullif(?, ''), ? FROM bookmarks WHERE id = ? AND url = ?`,
+		check.Status, message, check.RedirectUrl, check.Permanent, link.Id, link.Url)
+	return err
+}
+
+// Returns the user's bookmarks whose urls were broken or had moved for good
+// when last checked
+func (dbctx *DbContext) CheckedLinks(ctx context.Context) ([]CheckedLink, error) {
+	links := []CheckedLink{}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return links, err
+	}
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT b.url, ifnull(b.title, ''), c.checked, c.status, ifnull(c.error, ''), ifnull(c.redirectUrl, ''),
+					`+brokenLink+`, c.permanent
+					FROM bookmarks b JOIN link_checks c ON c.bookmark = b.id
+					WHERE b.owner = ? AND (`+brokenLink+` OR `+movedLink+`) ORDER BY b.url`, owner)
+	if err != nil {
+		return links, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var link CheckedLink
+		err = rows.Scan(&link.Url, &link.Title, &link.Checked, &link.Status, &link.Error, &link.RedirectUrl,
+			&link.Broken, &link.Permanent)
+		if err != nil {
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Points the user's bookmarks that had moved for good at the urls they moved
+// to, or with urls given, just those of them. Bookmarks are left alone if
+// where they moved to is broken or already bookmarked. The old urls are kept
+// as aliases. Returns how many were changed.
+func (dbctx *DbContext) FollowRedirects(ctx context.Context, urls []string) (int, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return 0, err
+	}
+	where := []string{"b.owner = ?", movedLink, "NOT " + brokenLink}
+	args := []any{owner}
+	if len(urls) > 0 {
+		where = append(where, "b.id IN ("+strings.Repeat(bookmarkByUrl+", ", len(urls)-1)+bookmarkByUrl+")")
+		for _, url := range urls {
+			args = append(args, dbctx.bookmarkArgs(owner, url)...)
+		}
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type move struct {
+		id     int64
+		oldUrl string
+		url    string
+	}
+	var moves []move
+	rows, err := tx.QueryContext(ctx, `SELECT b.id, b.url, c.redirectUrl
+					FROM bookmarks b JOIN link_checks c ON c.bookmark = b.id
+					WHERE `+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		var url, redirectUrl string
+		err = rows.Scan(&id, &url, &redirectUrl)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// redirects are followed to the url's normal form, like any other
+		// url that's bookmarked
+		redirectUrl = dbctx.urls.Normalize(redirectUrl)
+		if redirectUrl != url {
+			moves = append(moves, move{id, url, redirectUrl})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, m := range moves {
+		// or ignore skips bookmarks whose new url the user already has
+		result, err := tx.ExecContext(ctx, "UPDATE OR IGNORE bookmarks SET url = ?, urlWords = ? WHERE id = ?", m.url, urlWords(m.url), m.id)
+		if err != nil {
+			return 0, err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			continue
+		}
+		// the old url still finds the bookmark
+		_, err = tx.ExecContext(ctx, `INSERT INTO aliases (owner, url, bookmark) VALUES (?, ?, ?)
+					ON CONFLICT (owner, url) DO UPDATE SET bookmark = excluded.bookmark`, owner, m.oldUrl, m.id)
+		if err != nil {
+			return 0, err
+		}
+		updated++
+	}
+	return updated, tx.Commit()
+}
+
+// Returns the user's bookmarks that look to be for the same page, in groups
+func (dbctx *DbContext) Duplicates(ctx context.Context) ([]DuplicateGroup, error) {
+	groups := []DuplicateGroup{}
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return groups, err
+	}
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT url, ifnull(title, ''), ifnull(hitCount, 0), ifnull(favorite, 0), added
+					FROM bookmarks WHERE owner = ? ORDER BY url`, owner)
+	if err != nil {
+		return groups, err
+	}
+	defer rows.Close()
+	// in the order the first of each group turns up
+	var keys []string
+	byKey := make(map[string][]DuplicateBookmark)
+	for rows.Next() {
+		var bookmark DuplicateBookmark
+		var added sql.NullTime
+		err = rows.Scan(&bookmark.Url, &bookmark.Title, &bookmark.HitCount, &bookmark.IsFavorite, &added)
+		if err != nil {
+			return groups, err
+		}
+		bookmark.Added = added.Time
+		key := dbctx.urls.duplicateKey(bookmark.Url)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], bookmark)
+	}
+	if err = rows.Err(); err != nil {
+		return groups, err
+	}
+	for _, key := range keys {
+		if len(byKey[key]) > 1 {
+			groups = append(groups, DuplicateGroup{key, byKey[key]})
+		}
+	}
+	return groups, nil
+}
+
+// Merges the bookmarks for urls into the one for into, which takes on their
+// visits and tags, and is a favorite if any of them were. It keeps its own
+// title and notes unless it has none. The others are deleted, but their urls
+// carry on finding it as aliases.
+func (dbctx *DbContext) Merge(ctx context.Context, into string, urls []string) error {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	find := func(url string) (int64, error) {
+		var id int64
+		err := tx.QueryRowContext(ctx, "SELECT id FROM bookmarks WHERE id = "+bookmarkByUrl, dbctx.bookmarkArgs(owner, url)...).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return id, err
+	}
+	id, err := find(into)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		other, err := find(url)
+		if err != nil {
+			return err
+		}
+		if other == id {
+			continue
+		}
+		err = mergeInto(ctx, tx, owner, id, other)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Merges one of a user's bookmarks into another, deleting it and keeping its
+// url as an alias of the other
+func mergeInto(ctx context.Context, tx *sql.Tx, owner int64, id int64, other int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE bookmarks SET
+				hitCount = (SELECT sum(ifnull(hitCount, 0)) FROM bookmarks WHERE id IN (@id, @other)),
+				favorite = (SELECT max(favorite) FROM bookmarks WHERE id IN (@id, @other)),
+				lastAccess = (SELECT max(lastAccess) FROM bookmarks WHERE id IN (@id, @other)),
+				added = (SELECT min(added) FROM bookmarks WHERE id IN (@id, @other)),
+				title = CASE WHEN ifnull(title, '') = '' THEN (SELECT title FROM bookmarks WHERE id = @other) ELSE title END,
+				notes = CASE WHEN ifnull(notes, '') = '' THEN (SELECT notes FROM bookmarks WHERE id = @other) ELSE notes END
+				WHERE id = @id`,
+		sql.Named("id", id), sql.Named("other", other))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO bookmark_tags (bookmark, tag) SELECT ?, tag FROM bookmark_tags WHERE bookmark = ? ON CONFLICT DO NOTHING", id, other)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE visits SET bookmark = ? WHERE bookmark = ?", id, other)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE aliases SET bookmark = ? WHERE bookmark = ?", id, other)
+	if err != nil {
+		return err
+	}
+	err = addAlias(ctx, tx, owner, other, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE id = ?", other)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE bookmarks SET frecency = (SELECT score FROM frecency_scores WHERE bookmark = id) WHERE id = ?", id)
+	return err
+}
+
+// Remembers the url bookmark from has now as an alias of bookmark to
+func addAlias(ctx context.Context, tx *sql.Tx, owner int64, from int64, to int64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO aliases (owner, url, bookmark) SELECT ?, url, ? FROM bookmarks WHERE id = ?
+				ON CONFLICT (owner, url) DO UPDATE SET bookmark = excluded.bookmark`, owner, to, from)
+	return err
+}
+
+// How a restore treats the bookmarks already in the database
+type RestoreMode int
+
+const (
+	// Restored bookmarks replace any with the same url, and the rest are kept
+	RestoreMerge RestoreMode = iota
+	// Every one of the user's existing bookmarks is deleted first
+	RestoreReplace
+)
+
+// Stores times that may be unknown
+func nullableTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(sqliteTime)
+}
+
+// Writes bookmarks exactly as they were exported into the user's
+// collection, all in one transaction so that a bad dump leaves the database
+// untouched. Bookmarks that were still
+// waiting to be fetched are queued again. Returns the number restored.
+func (dbctx *DbContext) Restore(ctx context.Context, mode RestoreMode, bookmarks iter.Seq2[ExportedBookmark, error]) (int, error) {
+	owner, err := dbctx.owner(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if mode == RestoreReplace {
+		// jobs go along with their bookmarks
+		_, err = tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE owner = ?", owner)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for bookmark, err := range bookmarks {
+		if err != nil {
+			return 0, err
+		}
+		if bookmark.Status == "" {
+			bookmark.Status = "ok"
+		}
+		favorite := 0
+		if bookmark.IsFavorite {
+			favorite = 1
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE owner = ? AND url = ?", owner, bookmark.Url)
+		if err != nil {
+			return 0, err
+		}
+		iconHash, err := storeIcon(ctx, tx, bookmark.BookmarkData)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.ExecContext(ctx, `INSERT INTO bookmarks (owner, url, urlWords, title, notes, favorite, hitCount, added, lastAccess, icon,
+						description, canonicalUrl, siteName, imageUrl, author, status)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			owner, bookmark.Url, urlWords(bookmark.Url), bookmark.Title, bookmark.Notes, favorite, bookmark.HitCount,
+			nullableTime(bookmark.Added), nullableTime(bookmark.LastAccess), iconHash,
+			bookmark.Description, bookmark.CanonicalUrl, bookmark.SiteName, bookmark.ImageUrl, bookmark.Author, bookmark.Status)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", bookmark.Url, err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		for _, tag := range bookmark.Tags {
+			err = dbctx.tagBookmark(ctx, tx, owner, bookmark.Url, tag)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", bookmark.Url, err)
+			}
+		}
+		for _, visit := range bookmark.Visits {
+			_, err = tx.ExecContext(ctx, "INSERT INTO visits (bookmark, visited, client, userAgent) VALUES (?, ?, nullif(?, ''), nullif(?, ''))",
+				id, visit.Visited.UTC().Format(sqliteTime), visit.Client, visit.UserAgent)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", bookmark.Url, err)
+			}
+		}
+		for _, alias := range bookmark.Aliases {
+			_, err = tx.ExecContext(ctx, `INSERT INTO aliases (owner, url, bookmark) VALUES (?, ?, ?)
+						ON CONFLICT (owner, url) DO UPDATE SET bookmark = excluded.bookmark`, owner, alias, id)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", bookmark.Url, err)
+			}
+		}
+		if bookmark.Status == "pending" {
+			_, err = queueJob(ctx, tx, id)
+			if err != nil {
+				return 0, err
+			}
+		}
+		count++
+	}
+	// the restored visits decide where bookmarks come in frecency order
+	_, err = tx.ExecContext(ctx, "UPDATE bookmarks SET frecency = (SELECT score FROM frecency_scores WHERE bookmark = bookmarks.id) WHERE owner = ?", owner)
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// Stores the hash of a new API token for a user, returning its id
+func (dbctx *DbContext) AddToken(ctx context.Context, user string, hash string) (int64, error) {
+	result, err := dbctx.db.ExecContext(ctx, "INSERT INTO tokens (hash, user, created) VALUES (?, ?, datetime('now'))", hash, user)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Returns the user an API token belongs to, noting that it has been used
+func (dbctx *DbContext) TokenUser(ctx context.Context, hash string) (string, error) {
+	var user string
+	row := dbctx.db.QueryRowContext(ctx, "UPDATE tokens SET lastUsed = datetime('now') WHERE hash = ? RETURNING user", hash)
+	err := row.Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoToken
+	}
+	return user, err
+}
+
+// Lists the API tokens
+func (dbctx *DbContext) Tokens(ctx context.Context) ([]Token, error) {
+	rows, err := dbctx.db.QueryContext(ctx, "SELECT id, user, created, lastUsed FROM tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Token
+	for rows.Next() {
+		var token Token
+		err = rows.Scan(&token.Id, &token.User, &token.Created, &token.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, token)
+	}
+	return result, rows.Err()
+}
+
+// Deletes an API token
+func (dbctx *DbContext) RevokeToken(ctx context.Context, id int64) error {
+	result, err := dbctx.db.ExecContext(ctx, "DELETE FROM tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoToken
+	}
+	return nil
+}
+
+// Lists the users along with how many bookmarks each has
+func (dbctx *DbContext) Users(ctx context.Context) ([]User, error) {
+	rows, err := dbctx.db.QueryContext(ctx, `SELECT u.name, count(b.id) FROM users u
+					LEFT JOIN bookmarks b ON b.owner = u.id GROUP BY u.id ORDER BY u.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []User
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.Name, &user.Bookmarks)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// Renames a user, such as to hand the default user's bookmarks to someone
+// who logs in. Their API tokens follow them.
+func (dbctx *DbContext) RenameUser(ctx context.Context, name string, newName string) error {
+	tx, err := dbctx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET name = ? WHERE name = ?", newName, name)
+	if isDuplicateKey(err) {
+		return fmt.Errorf("user %q already exists", newName)
+	}
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no user %q", name)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET user = ? WHERE user = ?", newName, name)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	dbctx.mu.Lock()
+	clear(dbctx.users)
+	dbctx.mu.Unlock()
+	return nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -66,7 +69,7 @@ func TestFavorites(t *testing.T) {
 
 	// hit the one in second place, it should come first
 	secondPlace := faves[1].Url
-	err = db.Hit(ctx, secondPlace)
+	err = db.Hit(ctx, secondPlace, Visitor{})
 	assert.NilError(t, err)
 	newFaves, err := db.Favorites(ctx, 1)
 	assert.NilError(t, err)
@@ -117,9 +120,9 @@ func TestGetUpdatesLastAccessed(t *testing.T) {
 	db := setupTest(t)
 	ctx := context.Background()
 
-	_, err := db.db.Exec(`INSERT INTO bookmarks (url, title, lastAccess) VALUES ('http://example.com', 'bookmark', '2016-03-29')`)
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess) VALUES (1, 'http://example.com', 'bookmark', '2016-03-29')`)
 	assert.NilError(t, err)
-	_, err = db.db.Exec(`INSERT INTO bookmarks (url, title, lastAccess) VALUES ('http://example2.com', 'bookmark2', '2016-03-30')`)
+	_, err = db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess) VALUES (1, 'http://example2.com', 'bookmark2', '2016-03-30')`)
 	assert.NilError(t, err)
 
 	// example2 should be the first result
@@ -143,7 +146,7 @@ func TestInsertUpdatesLastAccessed(t *testing.T) {
 	db := setupTest(t)
 	ctx := context.Background()
 
-	_, err := db.db.Exec(`INSERT INTO bookmarks (url, title, lastAccess) VALUES ('http://example2.com', 'bookmark2', '2016-03-30')`)
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess) VALUES (1, 'http://example2.com', 'bookmark2', '2016-03-30')`)
 	assert.NilError(t, err)
 
 	// example2 should be the first result
@@ -161,3 +164,464 @@ func TestInsertUpdatesLastAccessed(t *testing.T) {
 	assert.Equal(t, "http://example.com", recents[0].Url)
 	assert.Equal(t, "bookmark", recents[0].Title)
 }
+
+func TestDelete(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{Title: "bookmark one"}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "bookmark two"}))
+
+	assert.NilError(t, db.Delete(ctx, "http://example.com"))
+	_, ok := db.Get(ctx, "http://example.com")
+	assert.Assert(t, !ok)
+
+	// deleting again should report that it's gone
+	assert.Assert(t, errors.Is(db.Delete(ctx, "http://example.com"), ErrNotFound))
+
+	// the fts index should no longer find the deleted bookmark
+	results, err := db.Search(ctx, "bookmark")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "http://example2.com", results[0].Url)
+}
+
+func TestUpdate(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{Title: ""}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "other"}))
+	assert.NilError(t, db.SetFavorite(ctx, "http://example.com", true))
+	assert.NilError(t, db.Hit(ctx, "http://example.com", Visitor{}))
+
+	// set a title
+	title := "my bookmark"
+	assert.NilError(t, db.Update(ctx, "http://example.com", BookmarkPatch{Title: &title}))
+	bookmark, ok := db.Get(ctx, "http://example.com")
+	assert.Assert(t, ok)
+	assert.Equal(t, "my bookmark", bookmark.Title)
+	results, err := db.Search(ctx, "my")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// move the bookmark, favorite and hit count should come along
+	newUrl := "https://example.com/"
+	assert.NilError(t, db.Update(ctx, "http://example.com", BookmarkPatch{Url: &newUrl}))
+	_, ok = db.Get(ctx, "http://example.com")
+	assert.Assert(t, !ok)
+	faves, err := db.Favorites(ctx, 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(faves))
+	assert.Equal(t, newUrl, faves[0].Url)
+	assert.Equal(t, "my bookmark", faves[0].Title)
+	var hitCount int
+	assert.NilError(t, db.db.QueryRow("SELECT hitCount FROM bookmarks WHERE url = ?", newUrl).Scan(&hitCount))
+	assert.Equal(t, 1, hitCount)
+	results, err = db.Search(ctx, "my")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, newUrl, results[0].Url)
+
+	// moving onto an existing bookmark is refused
+	otherUrl := "http://example2.com"
+	assert.Assert(t, errors.Is(db.Update(ctx, newUrl, BookmarkPatch{Url: &otherUrl}), ErrExists))
+
+	// updating a missing bookmark is refused
+	assert.Assert(t, errors.Is(db.Update(ctx, "http://foo.com", BookmarkPatch{Title: &title}), ErrNotFound))
+	assert.Assert(t, errors.Is(db.Update(ctx, "http://foo.com", BookmarkPatch{}), ErrNotFound))
+}
+
+func TestTags(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{Title: "bookmark one"}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "bookmark two"}))
+
+	// no tags yet
+	tags, err := db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(tags))
+
+	assert.NilError(t, db.AddTag(ctx, "http://example.com", "Golang"))
+	assert.NilError(t, db.AddTag(ctx, "http://example.com", "work"))
+	assert.NilError(t, db.AddTag(ctx, "http://example2.com", "golang"))
+	// adding twice is harmless
+	assert.NilError(t, db.AddTag(ctx, "http://example2.com", "golang"))
+
+	assert.Assert(t, errors.Is(db.AddTag(ctx, "http://foo.com", "golang"), ErrNotFound))
+	assert.Assert(t, errors.Is(db.AddTag(ctx, "http://example.com", "two words"), ErrInvalidTag))
+	assert.Assert(t, errors.Is(db.AddTag(ctx, "http://example.com", " "), ErrInvalidTag))
+
+	tags, err = db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tagList{{"golang", 2}, {"work", 1}}, tags)
+
+	// tags are reported with the bookmark
+	bookmarks, err := db.Tagged(ctx, "work", 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(bookmarks))
+	assert.Equal(t, "http://example.com", bookmarks[0].Url)
+	assert.DeepEqual(t, []string{"golang", "work"}, bookmarks[0].Tags)
+
+	bookmarks, err = db.Tagged(ctx, "golang", 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(bookmarks))
+
+	// tags are searchable
+	results, err := db.Search(ctx, "work")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "http://example.com", results[0].Url)
+
+	// removing the last use of a tag removes the tag
+	assert.NilError(t, db.RemoveTag(ctx, "http://example.com", "work"))
+	assert.Assert(t, errors.Is(db.RemoveTag(ctx, "http://example.com", "work"), ErrNotFound))
+	tags, err = db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tagList{{"golang", 2}}, tags)
+	results, err = db.Search(ctx, "work")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// tags follow a bookmark when it moves
+	newUrl := "https://example.com/"
+	assert.NilError(t, db.Update(ctx, "http://example.com", BookmarkPatch{Url: &newUrl}))
+	bookmarks, err = db.Tagged(ctx, "golang", 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(bookmarks))
+
+	// and are dropped when it is deleted
+	assert.NilError(t, db.Delete(ctx, newUrl))
+	assert.NilError(t, db.Delete(ctx, "http://example2.com"))
+	tags, err = db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(tags))
+}
+
+func TestNotes(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{Title: "gardening", Notes: "tips for growing tomatoes"}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "tomatoes", Notes: "a list of varieties"}))
+	assert.NilError(t, db.Insert(ctx, "http://example3.com", BookmarkData{Title: "cooking"}))
+
+	bookmark, ok := db.Get(ctx, "http://example.com")
+	assert.Assert(t, ok)
+	assert.Equal(t, "tips for growing tomatoes", bookmark.Notes)
+
+	// notes are searchable
+	results, err := db.Search(ctx, "growing")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "http://example.com", results[0].Url)
+	assert.Equal(t, "tips for growing tomatoes", results[0].Notes)
+
+	// title matches rank above note matches
+	results, err = db.Search(ctx, "tomatoes")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "http://example2.com", results[0].Url)
+
+	// notes can be edited
+	notes := "what to make for dinner"
+	assert.NilError(t, db.Update(ctx, "http://example3.com", BookmarkPatch{Notes: &notes}))
+	results, err = db.Search(ctx, "dinner")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "http://example3.com", results[0].Url)
+}
+
+func TestIcons(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	icon := []byte("icon data")
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{Title: "one", Icon: icon, IconType: "image/png"}))
+	assert.NilError(t, db.Insert(ctx, "http://example.com/two", BookmarkData{Title: "two", Icon: icon, IconType: "image/png"}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "three"}))
+
+	// identical icons are stored once
+	var count int
+	assert.NilError(t, db.db.QueryRow("SELECT count(*) FROM icons").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	stored, err := db.Icon(ctx, "http://example.com/two")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, icon, stored.Data)
+	assert.Equal(t, "image/png", stored.ContentType)
+	assert.Assert(t, stored.Hash != "")
+
+	_, err = db.Icon(ctx, "http://example2.com")
+	assert.Assert(t, errors.Is(err, ErrNotFound))
+	_, err = db.Icon(ctx, "http://foo.com")
+	assert.Assert(t, errors.Is(err, ErrNotFound))
+
+	// the icon goes away with the last bookmark using it
+	assert.NilError(t, db.Delete(ctx, "http://example.com"))
+	assert.NilError(t, db.db.QueryRow("SELECT count(*) FROM icons").Scan(&count))
+	assert.Equal(t, 1, count)
+	assert.NilError(t, db.Delete(ctx, "http://example.com/two"))
+	assert.NilError(t, db.db.QueryRow("SELECT count(*) FROM icons").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestMetadata(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com/?ref=feed", BookmarkData{
+		Title:        "title",
+		Description:  "description",
+		CanonicalUrl: "http://example.com/",
+		SiteName:     "site",
+		ImageUrl:     "http://example.com/image.jpg",
+		Author:       "author",
+	}))
+
+	recents, err := db.Recents(ctx, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(recents))
+	assert.Equal(t, "description", recents[0].Description)
+	assert.Equal(t, "http://example.com/", recents[0].CanonicalUrl)
+	assert.Equal(t, "site", recents[0].SiteName)
+	assert.Equal(t, "http://example.com/image.jpg", recents[0].ImageUrl)
+	assert.Equal(t, "author", recents[0].Author)
+}
+
+func TestUsers(t *testing.T) {
+	db := setupTest(t)
+	alice := withUser(context.Background(), "alice")
+	bob := withUser(context.Background(), "bob")
+
+	// both can have the same url, with their own state
+	assert.NilError(t, db.Insert(alice, "http://example.com", BookmarkData{Title: "alice's food"}))
+	assert.NilError(t, db.Insert(bob, "http://example.com", BookmarkData{Title: "bob's food"}))
+	assert.NilError(t, db.Insert(bob, "http://example2.com", BookmarkData{Title: "bob's other"}))
+	assert.NilError(t, db.SetFavorite(alice, "http://example.com", true))
+	assert.NilError(t, db.Hit(bob, "http://example.com", Visitor{}))
+	assert.NilError(t, db.AddTag(alice, "http://example.com", "mine"))
+
+	bookmark, ok := db.Get(alice, "http://example.com")
+	assert.Assert(t, ok)
+	assert.Equal(t, "alice's food", bookmark.Title)
+	_, ok = db.Get(alice, "http://example2.com")
+	assert.Assert(t, !ok)
+
+	recents, err := db.Recents(alice, 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(recents))
+	assert.DeepEqual(t, []string{"mine"}, recents[0].Tags)
+	favorites, err := db.Favorites(bob, 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(favorites))
+	results, err := db.Search(bob, "food")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "bob's food", results[0].Title)
+	tags, err := db.Tags(bob)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(tags))
+	exported, err := db.Bookmark(bob, "http://example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, exported.HitCount)
+	assert.Equal(t, false, exported.IsFavorite)
+
+	// deleting one leaves the other alone
+	assert.NilError(t, db.Delete(bob, "http://example.com"))
+	_, ok = db.Get(alice, "http://example.com")
+	assert.Assert(t, ok)
+
+	// without a user, it's the default user
+	assert.NilError(t, db.Insert(context.Background(), "http://example.com", BookmarkData{Title: "default"}))
+	users, err := db.Users(context.Background())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []User{{"alice", 1}, {"bob", 1}, {"default", 1}}, users)
+
+	// renaming hands over the bookmarks
+	assert.NilError(t, db.RenameUser(context.Background(), "default", "carol"))
+	bookmark, ok = db.Get(withUser(context.Background(), "carol"), "http://example.com")
+	assert.Assert(t, ok)
+	assert.Equal(t, "default", bookmark.Title)
+	assert.ErrorContains(t, db.RenameUser(context.Background(), "carol", "alice"), "already exists")
+}
+
+func TestMigrateToUsers(t *testing.T) {
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer sqlDb.Close()
+	// a single connection, so that everything sees the same in-memory
+	// database
+	sqlDb.SetMaxOpenConns(1)
+
+	// a database from before there were users
+	assert.NilError(t, applySchema(sqlDb, 0, 10))
+	db := &DbContext{db: sqlDb, urls: NewUrlNormalizer(nil), users: make(map[string]int64)}
+	_, err = sqlDb.Exec(`INSERT INTO bookmarks (url, title, lastAccess, hitCount, favorite, added) VALUES
+			('http://example.com', 'old food', '2016-03-29', 3, 1, '2016-03-01'),
+			('http://example2.com', 'pending', '2016-03-30', 0, 0, '2016-03-02')`)
+	assert.NilError(t, err)
+	_, err = sqlDb.Exec(`INSERT INTO tags (id, name) VALUES (1, 'old')`)
+	assert.NilError(t, err)
+	_, err = sqlDb.Exec(`INSERT INTO bookmark_tags (url, tag) VALUES ('http://example.com', 1)`)
+	assert.NilError(t, err)
+	_, err = sqlDb.Exec(`INSERT INTO jobs (url, state, nextAttempt, created, updated)
+			VALUES ('http://example2.com', 'queued', datetime('now'), datetime('now'), datetime('now'))`)
+	assert.NilError(t, err)
+
+	assert.NilError(t, applySchema(sqlDb, 10, len(schema)))
+
+	// everything now belongs to the default user
+	ctx := context.Background()
+	bookmark, err := db.Bookmark(ctx, "http://example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, "old food", bookmark.Title)
+	assert.Equal(t, 3, bookmark.HitCount)
+	assert.Equal(t, true, bookmark.IsFavorite)
+	assert.DeepEqual(t, []string{"old"}, bookmark.Tags)
+	results, err := db.Search(ctx, "food")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	job, ok, err := db.ClaimJob(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, "http://example2.com", job.Url)
+
+	// and the triggers still work
+	assert.NilError(t, db.RemoveTag(ctx, "http://example.com", "old"))
+	tags, err := db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(tags))
+	assert.NilError(t, db.Delete(ctx, "http://example2.com"))
+	_, err = db.Job(ctx, job.Id)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSearchUrl(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "https://www.github.com/rcbilson/bookmarks?utm_source=news#readme", BookmarkData{}))
+	assert.NilError(t, db.Insert(ctx, "http://example.com/about", BookmarkData{Title: "all about github"}))
+
+	for _, test := range []struct {
+		pattern  string
+		expCount int
+	}{
+		{"github", 2},
+		{"rcbilson bookmarks", 1},
+		{"site:example.com about", 1},
+		{"www", 0},
+		{"https", 0},
+		{"utm", 0},
+		{"readme", 0},
+	} {
+		results, err := db.Search(ctx, test.pattern)
+		assert.NilError(t, err)
+		assert.Equal(t, test.expCount, len(results), test.pattern)
+	}
+
+	// the title counts for more than the url
+	results, err := db.Search(ctx, "github")
+	assert.NilError(t, err)
+	assert.Equal(t, "http://example.com/about", results[0].Url)
+
+	// the url words follow the url around
+	newUrl := "https://codeberg.org/rcbilson/bookmarks"
+	assert.NilError(t, db.Update(ctx, "https://www.github.com/rcbilson/bookmarks?utm_source=news#readme", BookmarkPatch{Url: &newUrl}))
+	results, err = db.Search(ctx, "codeberg")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	results, err = db.Search(ctx, "github")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// bookmarks added by hand, with nothing but sql, get their words when
+	// the database is next opened
+	_, err = db.db.Exec(`INSERT INTO bookmarks (owner, url, title) VALUES (1, 'https://sourcehut.org/rcbilson', 'by hand')`)
+	assert.NilError(t, err)
+	results, err = db.Search(ctx, "sourcehut")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(results))
+	assert.NilError(t, applySchema(db.db, len(schema), len(schema)))
+	results, err = db.Search(ctx, "sourcehut")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	results, err = db.Search(ctx, "rcbilson")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(results))
+}
+
+func TestFrecency(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	// an old favorite, opened a lot a long time ago
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess, hitCount, favorite) VALUES
+			(1, 'http://old.com', 'daily news', datetime('now', '-200 days'), 20, 1)`)
+	assert.NilError(t, err)
+	_, err = db.db.Exec(`INSERT INTO visits (bookmark, visited) SELECT id, datetime('now', '-200 days') FROM bookmarks`)
+	assert.NilError(t, err)
+	// and this week's, opened a few times lately
+	assert.NilError(t, db.Insert(ctx, "http://new.com", BookmarkData{Title: "daily news"}))
+	assert.NilError(t, db.SetFavorite(ctx, "http://new.com", true))
+	for range 3 {
+		assert.NilError(t, db.Hit(ctx, "http://new.com", Visitor{}))
+	}
+	// hits on bookmarks that aren't there are ignored
+	assert.NilError(t, db.Hit(ctx, "http://nowhere.com", Visitor{}))
+	assert.NilError(t, db.RefreshFrecency(ctx))
+
+	var frecency float64
+	assert.NilError(t, db.db.QueryRow("SELECT frecency FROM bookmarks WHERE url = 'http://old.com'").Scan(&frecency))
+	assert.Equal(t, 200.0, frecency)
+	assert.NilError(t, db.db.QueryRow("SELECT frecency FROM bookmarks WHERE url = 'http://new.com'").Scan(&frecency))
+	assert.Equal(t, 300.0, frecency)
+
+	favorites, err := db.Favorites(ctx, 5)
+	assert.NilError(t, err)
+	assert.Equal(t, "http://new.com", favorites[0].Url)
+	page, err := db.Page(ctx, PageRequest{Sort: SortFrequent, Count: 5})
+	assert.NilError(t, err)
+	assert.Equal(t, "http://old.com", page.Items[0].Url)
+
+	// equally good matches come out in order of frecency
+	results, err := db.Search(ctx, "news")
+	assert.NilError(t, err)
+	assert.Equal(t, "http://new.com", results[0].Url)
+
+	// without visits, the last access stands in for them
+	_, err = db.db.Exec(`DELETE FROM visits`)
+	assert.NilError(t, err)
+	_, err = db.db.Exec(`UPDATE bookmarks SET lastAccess = datetime('now', '-20 days') WHERE url = 'http://new.com'`)
+	assert.NilError(t, err)
+	assert.NilError(t, db.RefreshFrecency(ctx))
+	assert.NilError(t, db.db.QueryRow("SELECT frecency FROM bookmarks WHERE url = 'http://new.com'").Scan(&frecency))
+	assert.Equal(t, 150.0, frecency)
+
+	// a refresh interval that isn't positive falls back to the default
+	// rather than panicking
+	_, err = db.db.Exec(`UPDATE bookmarks SET frecency = 0`)
+	assert.NilError(t, err)
+	refreshing, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		refreshFrecency(refreshing, db, 0)
+		close(done)
+	}()
+	for frecency = 0; frecency == 0; time.Sleep(time.Millisecond) {
+		assert.NilError(t, db.db.QueryRow("SELECT frecency FROM bookmarks WHERE url = 'http://new.com'").Scan(&frecency))
+	}
+	cancel()
+	<-done
+	assert.Equal(t, 150.0, frecency)
+
+	// visits go with their bookmark
+	assert.NilError(t, db.Hit(ctx, "http://new.com", Visitor{}))
+	assert.NilError(t, db.Delete(ctx, "http://new.com"))
+	var visits int
+	assert.NilError(t, db.db.QueryRow("SELECT count(*) FROM visits").Scan(&visits))
+	assert.Equal(t, 0, visits)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+)
+
+// Identifies the first line of a dump
+const dumpFormat = "bookmarks-dump"
+
+// The first line of a dump. The schema version records which fields the
+// database had when the dump was written.
+type dumpHeader struct {
+	Format        string    `json:"format"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Exported      time.Time `json:"exported"`
+}
+
+// Each line after the header holds everything stored about one bookmark
+type dumpBookmark struct {
+	Url          string      `json:"url"`
+	Title        string      `json:"title"`
+	Notes        string      `json:"notes"`
+	Tags         []string    `json:"tags"`
+	IsFavorite   bool        `json:"isFavorite"`
+	HitCount     int         `json:"hitCount"`
+	Added        *time.Time  `json:"added"`
+	LastAccess   *time.Time  `json:"lastAccess"`
+	Status       string      `json:"status"`
+	Description  string      `json:"description"`
+	CanonicalUrl string      `json:"canonicalUrl"`
+	SiteName     string      `json:"siteName"`
+	ImageUrl     string      `json:"imageUrl"`
+	Author       string      `json:"author"`
+	Visits       []dumpVisit `json:"visits"`
+	Aliases      []string    `json:"aliases"`
+	IconType     string      `json:"iconType,omitempty"`
+	Icon         []byte      `json:"icon,omitempty"`
+}
+
+// A visit to a bookmark, as recorded in its history
+type dumpVisit struct {
+	Visited   time.Time `json:"visited"`
+	Client    string    `json:"client,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// Unknown times are written as null
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newDumpBookmark(bookmark ExportedBookmark) dumpBookmark {
+	tags := bookmark.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	aliases := bookmark.Aliases
+	if aliases == nil {
+		aliases = []string{}
+	}
+	visits := make([]dumpVisit, len(bookmark.Visits))
+	for i, visit := range bookmark.Visits {
+		visits[i] = dumpVisit{visit.Visited.UTC(), visit.Client, visit.UserAgent}
+	}
+	return dumpBookmark{
+		Url:          bookmark.Url,
+		Title:        bookmark.Title,
+		Notes:        bookmark.Notes,
+		Tags:         tags,
+		IsFavorite:   bookmark.IsFavorite,
+		HitCount:     bookmark.HitCount,
+		Added:        optionalTime(bookmark.Added),
+		LastAccess:   optionalTime(bookmark.LastAccess),
+		Status:       bookmark.Status,
+		Description:  bookmark.Description,
+		CanonicalUrl: bookmark.CanonicalUrl,
+		SiteName:     bookmark.SiteName,
+		ImageUrl:     bookmark.ImageUrl,
+		Author:       bookmark.Author,
+		Visits:       visits,
+		Aliases:      aliases,
+		IconType:     bookmark.IconType,
+		Icon:         bookmark.Icon,
+	}
+}
+
+func (dump dumpBookmark) bookmark() ExportedBookmark {
+	bookmark := ExportedBookmark{
+		ImportedBookmark: ImportedBookmark{
+			Url: dump.Url,
+			BookmarkData: BookmarkData{
+				Title:        dump.Title,
+				Notes:        dump.Notes,
+				Icon:         dump.Icon,
+				IconType:     dump.IconType,
+				Description:  dump.Description,
+				CanonicalUrl: dump.CanonicalUrl,
+				SiteName:     dump.SiteName,
+				ImageUrl:     dump.ImageUrl,
+				Author:       dump.Author,
+			},
+			Tags: dump.Tags,
+		},
+		IsFavorite: dump.IsFavorite,
+		HitCount:   dump.HitCount,
+		Status:     dump.Status,
+		Aliases:    dump.Aliases,
+	}
+	if dump.Added != nil {
+		bookmark.Added = *dump.Added
+	}
+	if dump.LastAccess != nil {
+		bookmark.LastAccess = *dump.LastAccess
+	}
+	for _, visit := range dump.Visits {
+		bookmark.Visits = append(bookmark.Visits, ExportedVisit{visit.Visited, visit.Client, visit.UserAgent})
+	}
+	return bookmark
+}
+
+// Writes every bookmark as newline-delimited JSON: a header line followed by
+// one line per bookmark, read from the database as they are written.
+func exportDump(ctx context.Context, db Db, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(dumpHeader{dumpFormat, len(schema), time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return db.Export(ctx, func(bookmark ExportedBookmark) error {
+		return encoder.Encode(newDumpBookmark(bookmark))
+	})
+}
+
+// Reads the header of a dump, returning the bookmarks that follow it. Dumps
+// from older schema versions are fine, since fields they lack just take
+// their defaults, but newer ones may hold things this server would lose.
+func readDump(r io.Reader) (iter.Seq2[ExportedBookmark, error], error) {
+	decoder := json.NewDecoder(r)
+	var header dumpHeader
+	err := decoder.Decode(&header)
+	if err != nil {
+		return nil, fmt.Errorf("reading dump header: %w", err)
+	}
+	if header.Format != dumpFormat {
+		return nil, errors.New("not a bookmarks dump")
+	}
+	if header.SchemaVersion > len(schema) {
+		return nil, fmt.Errorf("dump is from schema version %d, newer than this server's %d", header.SchemaVersion, len(schema))
+	}
+	return func(yield func(ExportedBookmark, error) bool) {
+		for n := 1; ; n++ {
+			var dump dumpBookmark
+			err := decoder.Decode(&dump)
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err == nil && dump.Url == "" {
+				err = errors.New("no url")
+			}
+			if err != nil {
+				yield(ExportedBookmark{}, fmt.Errorf("bookmark %d: %w", n, err))
+				return
+			}
+			if !yield(dump.bookmark(), nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// Parses the mode parameter of a restore, which defaults to merging
+func parseRestoreMode(mode string) (RestoreMode, error) {
+	switch mode {
+	case "", "merge":
+		return RestoreMerge, nil
+	case "replace":
+		return RestoreReplace, nil
+	}
+	return RestoreMerge, fmt.Errorf("unknown mode %q", mode)
+}
+
+// Restores a dump written by exportDump
+func importDump(ctx context.Context, db Db, r io.Reader, mode RestoreMode) (importSummary, error) {
+	bookmarks, err := readDump(r)
+	if err != nil {
+		return importSummary{}, err
+	}
+	count, err := db.Restore(ctx, mode, bookmarks)
+	if err != nil {
+		return importSummary{}, err
+	}
+	return importSummary{Imported: count, Errors: []string{}}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Sets up a database with a bit of everything in it
+func dumpTestDb(t *testing.T) *DbContext {
+	db := setupTest(t)
+	ctx := context.Background()
+	assert.NilError(t, db.Import(ctx, ImportedBookmark{
+		Url: "https://example.com/fish",
+		BookmarkData: BookmarkData{
+			Title: "Fish", Notes: "crispy", Icon: []byte("icon"), IconType: "image/png",
+			Description: "all about fish", SiteName: "Example", Author: "Someone",
+		},
+		Tags:       []string{"food", "uk"},
+		Added:      time.Unix(1500000000, 0),
+		LastAccess: time.Unix(1600000000, 0),
+	}))
+	assert.NilError(t, db.Insert(ctx, "https://go.dev/", BookmarkData{Title: "Go"}))
+	assert.NilError(t, db.Insert(ctx, "https://golang.org/", BookmarkData{Title: "Go"}))
+	assert.NilError(t, db.Merge(ctx, "https://go.dev/", []string{"https://golang.org/"}))
+	assert.NilError(t, db.SetFavorite(ctx, "https://go.dev/", true))
+	assert.NilError(t, db.Hit(ctx, "https://go.dev/", Visitor{Client: "laptop", UserAgent: "curl/8.0"}))
+	_, err := db.AddPending(ctx, "https://example.com/pending", BookmarkData{Notes: "later"}, false)
+	assert.NilError(t, err)
+	return db
+}
+
+// Exports a dump, leaving out the header since its timestamp varies
+func dumpBody(t *testing.T, db Db) string {
+	var out strings.Builder
+	assert.NilError(t, exportDump(context.Background(), db, &out))
+	_, body, _ := strings.Cut(out.String(), "\n")
+	return body
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	source := dumpTestDb(t)
+	var dump strings.Builder
+	assert.NilError(t, exportDump(context.Background(), source, &dump))
+
+	db := setupTest(t)
+	summary, err := importDump(context.Background(), db, strings.NewReader(dump.String()), RestoreReplace)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, summary.Imported)
+	assert.Equal(t, dumpBody(t, source), dumpBody(t, db))
+
+	// and their visits go along with them
+	history, err := db.History(context.Background(), HistoryRequest{Count: 10})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(history.Items))
+	assert.Equal(t, "https://go.dev/", history.Items[0].Url)
+	assert.Equal(t, "laptop", history.Items[0].Client)
+	assert.Equal(t, "curl/8.0", history.Items[0].UserAgent)
+
+	// as do their aliases
+	bookmark, err := db.Bookmark(context.Background(), "https://golang.org/")
+	assert.NilError(t, err)
+	assert.Equal(t, "https://go.dev/", bookmark.Url)
+
+	// bookmarks keep their place in frecency order
+	page, err := db.Page(context.Background(), PageRequest{Sort: SortFrecency, Count: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, "https://go.dev/", page.Items[0].Url)
+
+	// the bookmark still waiting to be fetched is queued again
+	job, ok, err := db.ClaimJob(context.Background())
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, "https://example.com/pending", job.Url)
+}
+
+func TestDumpMerge(t *testing.T) {
+	var dump strings.Builder
+	assert.NilError(t, exportDump(context.Background(), dumpTestDb(t), &dump))
+
+	ctx := context.Background()
+	db := setupTest(t)
+	assert.NilError(t, db.Insert(ctx, "https://go.dev/", BookmarkData{Title: "Old title"}))
+	assert.NilError(t, db.Insert(ctx, "https://example.com/mine", BookmarkData{Title: "Mine"}))
+
+	_, err := importDump(ctx, db, strings.NewReader(dump.String()), RestoreMerge)
+	assert.NilError(t, err)
+
+	// the dump wins over what was there, and everything else is kept
+	bookmark, ok := db.Get(ctx, "https://go.dev/")
+	assert.Assert(t, ok)
+	assert.Equal(t, "Go", bookmark.Title)
+	_, ok = db.Get(ctx, "https://example.com/mine")
+	assert.Assert(t, ok)
+
+	// replacing leaves only what was in the dump
+	_, err = importDump(ctx, db, strings.NewReader(dump.String()), RestoreReplace)
+	assert.NilError(t, err)
+	_, ok = db.Get(ctx, "https://example.com/mine")
+	assert.Assert(t, !ok)
+}
+
+func TestDumpErrors(t *testing.T) {
+	ctx := context.Background()
+	db := setupTest(t)
+	assert.NilError(t, db.Insert(ctx, "https://example.com/mine", BookmarkData{Title: "Mine"}))
+
+	// a bad line part way through leaves the database untouched
+	dump := `{"format":"bookmarks-dump","schemaVersion":1}
+{"url":"https://example.com/one","title":"One"}
+{"title":"no url"}
+`
+	_, err := importDump(ctx, db, strings.NewReader(dump), RestoreReplace)
+	assert.ErrorContains(t, err, "bookmark 2: no url")
+	_, ok := db.Get(ctx, "https://example.com/mine")
+	assert.Assert(t, ok)
+	_, ok = db.Get(ctx, "https://example.com/one")
+	assert.Assert(t, !ok)
+
+	_, err = importDump(ctx, db, strings.NewReader(`{"format":"bookmarks-dump","schemaVersion":1000}`), RestoreMerge)
+	assert.ErrorContains(t, err, "newer than this server's")
+
+	_, err = importDump(ctx, db, strings.NewReader(`<DL></DL>`), RestoreMerge)
+	assert.ErrorContains(t, err, "header")
+}
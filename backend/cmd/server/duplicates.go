@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Bookmarks whose urls come down to the same thing
+type DuplicateGroup struct {
+	// What the urls have in common: their normal form, less the scheme and
+	// any www.
+	Key       string              `json:"key"`
+	Bookmarks []DuplicateBookmark `json:"bookmarks"`
+}
+
+// Enough of a bookmark to decide which of its duplicates to keep
+type DuplicateBookmark struct {
+	Url        string    `json:"url"`
+	Title      string    `json:"title"`
+	HitCount   int       `json:"hitCount"`
+	IsFavorite bool      `json:"isFavorite"`
+	Added      time.Time `json:"added"`
+}
+
+func fetchDuplicates(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := db.Duplicates(r.Context())
+		if err != nil {
+			logError(w, fmt.Sprintf("Error finding duplicates: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	}
+}
+
+// Merges the bookmarks named by url parameters into the one named by into
+func mergeBookmarks(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		into, ok := r.URL.Query()["into"]
+		if !ok {
+			logError(w, "No url to merge into provided", http.StatusBadRequest)
+			return
+		}
+		urls, ok := r.URL.Query()["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		err := db.Merge(r.Context(), into[0], urls)
+		if errors.Is(err, ErrNotFound) {
+			logError(w, "No such bookmark", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error merging bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
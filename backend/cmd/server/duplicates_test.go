@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDuplicates(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	bob := withUser(ctx, "bob")
+
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, notes, lastAccess, added, hitCount, favorite) VALUES
+			(1, 'http://x.com', '', '', '2025-03-01', '2025-01-01', 2, 0),
+			(1, 'https://www.x.com/', 'X', 'some notes', '2025-03-05', '2025-02-01', 3, 1),
+			(1, 'https://x.com/?utm_source=foo', 'X again', '', NULL, '2025-01-15', 1, 0),
+			(1, 'https://x.com/other', 'Other', '', NULL, '2025-01-01', 0, 0),
+			(1, 'https://y.com/a#one', 'Y', '', NULL, '2025-01-01', 0, 0),
+			(1, 'https://y.com/a#two', 'Y', '', NULL, '2025-01-01', 0, 0)`)
+	assert.NilError(t, err)
+	assert.NilError(t, db.Insert(bob, "https://x.com", BookmarkData{Title: "bob's"}))
+	assert.NilError(t, db.AddTag(ctx, "http://x.com", "site"))
+	assert.NilError(t, db.AddTag(ctx, "https://www.x.com/", "site"))
+	assert.NilError(t, db.AddTag(ctx, "https://www.x.com/", "letters"))
+	assert.NilError(t, db.Hit(ctx, "https://www.x.com/", Visitor{}))
+
+	groups, err := db.Duplicates(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "x.com", groups[0].Key)
+	assert.Equal(t, 3, len(groups[0].Bookmarks))
+	assert.Equal(t, "http://x.com", groups[0].Bookmarks[0].Url)
+	assert.Equal(t, "y.com/a", groups[1].Key)
+
+	assert.NilError(t, db.Merge(ctx, "http://x.com", []string{"https://www.x.com/", "https://x.com/?utm_source=foo", "http://x.com"}))
+	bookmark, err := db.Bookmark(ctx, "http://x.com")
+	assert.NilError(t, err)
+	assert.Equal(t, 7, bookmark.HitCount)
+	assert.Assert(t, bookmark.IsFavorite)
+	// it had no title or notes of its own
+	assert.Equal(t, "X", bookmark.Title)
+	assert.Equal(t, "some notes", bookmark.Notes)
+	assert.DeepEqual(t, []string{"letters", "site"}, bookmark.Tags)
+	stats, err := db.Stats(ctx, "http://x.com")
+	assert.NilError(t, err)
+	assert.Equal(t, "2025-01-01", stats.Added.Format("2006-01-02"))
+	assert.Equal(t, 1, len(stats.Weeks))
+	var count int
+	assert.NilError(t, db.db.QueryRow("SELECT count(*) FROM bookmarks WHERE owner = 1").Scan(&count))
+	assert.Equal(t, 4, count)
+	// but the merged urls still find it
+	bookmark, err = db.Bookmark(ctx, "https://www.x.com/")
+	assert.NilError(t, err)
+	assert.Equal(t, "http://x.com", bookmark.Url)
+	merged, ok := db.Get(ctx, "https://www.x.com/")
+	assert.Assert(t, ok)
+	assert.Equal(t, "X", merged.Title)
+
+	groups, err = db.Duplicates(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(groups))
+	// the other user's bookmarks are out of reach
+	assert.Equal(t, ErrNotFound, db.Merge(ctx, "https://y.com/a#one", []string{"https://x.com"}))
+	_, ok = db.Get(bob, "https://x.com")
+	assert.Assert(t, ok)
+}
+
+func TestDuplicateHandlers(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	for _, url := range []string{"http://x.com", "https://x.com/", "https://y.com"} {
+		assert.NilError(t, db.Insert(ctx, url, BookmarkData{Title: url}))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/duplicates", nil)
+	w := httptest.NewRecorder()
+	fetchDuplicates(db)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var groups []DuplicateGroup
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&groups))
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, 2, len(groups[0].Bookmarks))
+
+	merge := func(params url.Values, expStatus int) {
+		req := httptest.NewRequest(http.MethodPost, "/api/merge?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		mergeBookmarks(db)(w, req)
+		assert.Equal(t, expStatus, w.Code)
+	}
+	merge(url.Values{"url": {"http://x.com"}}, http.StatusBadRequest)
+	merge(url.Values{"into": {"https://x.com/"}}, http.StatusBadRequest)
+	merge(url.Values{"into": {"https://x.com/"}, "url": {"http://z.com"}}, http.StatusNotFound)
+	merge(url.Values{"into": {"https://x.com/"}, "url": {"http://x.com"}}, http.StatusOK)
+	bookmark, err := db.Bookmark(ctx, "http://x.com")
+	assert.NilError(t, err)
+	assert.Equal(t, "https://x.com/", bookmark.Url)
+}
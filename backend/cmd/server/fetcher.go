@@ -3,94 +3,409 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/publicsuffix"
 )
 
 type BookmarkData struct {
-	Title string
-	Icon  []byte
+	Title        string
+	Notes        string
+	Icon         []byte
+	IconType     string
+	Description  string
+	CanonicalUrl string
+	SiteName     string
+	ImageUrl     string
+	Author       string
+	// Where the page was fetched from in the end, after any redirects
+	FinalUrl string
+}
+
+// Returns the url that best identifies the page: its canonical url if it
+// declares one on the same site, or else where it redirected to, if anywhere.
+// A canonical url on some other site is ignored, since any page can claim to
+// be any other.
+func (bookmark BookmarkData) preferredUrl() string {
+	final, err := url.Parse(bookmark.FinalUrl)
+	if err != nil || (final.Scheme != "http" && final.Scheme != "https") || final.Host == "" {
+		return ""
+	}
+	canonical, err := url.Parse(bookmark.CanonicalUrl)
+	if err == nil && (canonical.Scheme == "http" || canonical.Scheme == "https") && sameSite(canonical, final) {
+		return bookmark.CanonicalUrl
+	}
+	return bookmark.FinalUrl
+}
+
+// Whether two urls are on the same site: the same host, or hosts under the
+// same registrable domain, such as www.example.com and example.com
+func sameSite(a *url.URL, b *url.URL) bool {
+	aHost := strings.ToLower(a.Hostname())
+	bHost := strings.ToLower(b.Hostname())
+	if aHost == "" || bHost == "" {
+		return false
+	}
+	if aHost == bHost {
+		return true
+	}
+	aSite, err := publicsuffix.EffectiveTLDPlusOne(aHost)
+	if err != nil {
+		return false
+	}
+	bSite, err := publicsuffix.EffectiveTLDPlusOne(bHost)
+	return err == nil && aSite == bSite
 }
 
 type Fetcher interface {
 	Fetch(ctx context.Context, url string) ([]byte, error)
 	FetchBookmark(ctx context.Context, url string) (BookmarkData, error)
+	Allowed(ctx context.Context, url string) error
+	Check(ctx context.Context, url string) (LinkCheck, error)
+}
+
+// Limits on what the fetcher will do on behalf of a single request. Zero
+// values are replaced by defaults.
+type FetcherConfig struct {
+	// Overall time allowed for a request, including redirects and reading
+	// the body, and for fetching a bookmark along with its icon
+	Timeout time.Duration
+	// Bodies are truncated beyond this size
+	MaxBodyBytes int64
+	// Redirects allowed before giving up
+	MaxRedirects int
+	// Addresses that aren't on the public internet are refused unless they
+	// fall in one of these ranges
+	AllowedNetworks []netip.Prefix
+}
+
+var defaultFetcherConfig = FetcherConfig{
+	Timeout:      30 * time.Second,
+	MaxBodyBytes: 5 << 20,
+	MaxRedirects: 10,
 }
 
 type FetcherImpl struct {
+	client       *http.Client
+	policy       *fetchPolicy
+	maxBodyBytes int64
+	timeout      time.Duration
 }
 
-func NewFetcher() (Fetcher, error) {
-	return &FetcherImpl{}, nil
+func NewFetcher(config FetcherConfig) (Fetcher, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultFetcherConfig.Timeout
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultFetcherConfig.MaxBodyBytes
+	}
+	if config.MaxRedirects <= 0 {
+		config.MaxRedirects = defaultFetcherConfig.MaxRedirects
+	}
+
+	policy := &fetchPolicy{allowed: config.AllowedNetworks}
+
+	// one transport shared by every fetch so that connections are reused
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = policy.dialer().DialContext
+	// a proxy would be the only address the policy ever saw
+	transport.Proxy = nil
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 4
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = config.Timeout
+	transport.ExpectContinueTimeout = time.Second
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= config.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", config.MaxRedirects)
+			}
+			return policy.checkUrl(req.URL)
+		},
+	}
+	return &FetcherImpl{client: client, policy: policy, maxBodyBytes: config.MaxBodyBytes, timeout: config.Timeout}, nil
 }
 
-func (*FetcherImpl) Fetch(ctx context.Context, url string) ([]byte, error) {
-	var httpClient http.Client
+// The result of a successful fetch
+type fetchResult struct {
+	// nil if the content type was not accepted
+	body        []byte
+	contentType string
+	// the url the content was ultimately retrieved from, after redirects
+	url *url.URL
+	// true if the body was cut short at the size limit
+	truncated bool
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// Accepts any content type
+func anyContent(string) bool {
+	return true
+}
+
+// Accepts content types that can be parsed for a title. Servers that don't
+// say are given the benefit of the doubt.
+func htmlContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return contentType == "" || err != nil ||
+		mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func (fetcher *FetcherImpl) Fetch(ctx context.Context, url string) ([]byte, error) {
+	result, err := fetcher.fetch(ctx, url, anyContent, false)
+	if err != nil {
+		return nil, err
+	}
+	return result.body, nil
+}
+
+// Returns a PolicyError if the url is not one the fetcher will retrieve
+func (fetcher *FetcherImpl) Allowed(ctx context.Context, rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return &PolicyError{rawUrl, err.Error()}
+	}
+	return fetcher.policy.checkHost(ctx, u)
+}
+
+// Makes a request for a url the policy allows
+func (fetcher *FetcherImpl) newRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = fetcher.policy.checkUrl(req.URL)
 	if err != nil {
 		return nil, err
 	}
 	// spoof user agent to work around bot detection
 	req.Header["User-Agent"] = []string{"Mozilla/5.0 (X11; CrOS x86_64 8172.45.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/51.0.2704.64 Safari/537.36"}
-	res, err := httpClient.Do(req)
+	return req, nil
+}
+
+// Retrieves a url, reading the body only if accept approves of its content
+// type. Speculative requests, for things that may well not be there, fail
+// without logging the response.
+func (fetcher *FetcherImpl) fetch(ctx context.Context, url string, accept func(contentType string) bool, speculative bool) (*fetchResult, error) {
+	req, err := fetcher.newRequest(ctx, http.MethodGet, url)
+	if err != nil {
+		return nil, err
+	}
+	res, err := fetcher.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
-	res.Body.Close()
+	if res.StatusCode > 299 && speculative {
+		return nil, fmt.Errorf("response failed with status code: %d", res.StatusCode)
+	}
 	if res.StatusCode > 299 {
 		log.Println("Headers:")
 		for k, v := range res.Header {
 			log.Println("    ", k, ":", v)
 		}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
 		return nil, fmt.Errorf("response failed with status code: %d and\nbody: %s", res.StatusCode, body)
 	}
+
+	result := &fetchResult{contentType: res.Header.Get("Content-Type"), url: res.Request.URL}
+	if !accept(result.contentType) {
+		return result, nil
+	}
+	// read one byte past the limit to find out whether there was more
+	body, err := io.ReadAll(io.LimitReader(res.Body, fetcher.maxBodyBytes+1))
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	if int64(len(body)) > fetcher.maxBodyBytes {
+		body = body[:fetcher.maxBodyBytes]
+		result.truncated = true
+	}
+	result.body = body
+	return result, nil
 }
 
-func findChild(n *html.Node, dataAtom atom.Atom) *html.Node {
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.DataAtom == dataAtom {
-			return c
-		}
+// What came of requesting a bookmarked url to see whether it still works
+type LinkCheck struct {
+	// The status of the final response, after any redirects
+	Status int
+	// Where the url redirected to, or "" if it didn't
+	RedirectUrl string
+	// Whether every redirect on the way was a permanent one, so that the
+	// bookmark might as well point at RedirectUrl instead
+	Permanent bool
+}
+
+// Requests a url to find out whether it still works, returning an error only
+// if there was no response at all. It asks with HEAD, to save sending the
+// page, but enough servers mishandle HEAD that anything short of success is
+// asked again with GET.
+func (fetcher *FetcherImpl) Check(ctx context.Context, url string) (LinkCheck, error) {
+	check, err := fetcher.check(ctx, http.MethodHead, url)
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) || (err == nil && check.Status < 400) {
+		return check, err
 	}
-	return nil
+	return fetcher.check(ctx, http.MethodGet, url)
 }
 
-func (fetcher *FetcherImpl) FetchBookmark(ctx context.Context, url string) (bookmark BookmarkData, err error) {
-	page, err := fetcher.Fetch(ctx, url)
+func (fetcher *FetcherImpl) check(ctx context.Context, method string, url string) (LinkCheck, error) {
+	req, err := fetcher.newRequest(ctx, method, url)
 	if err != nil {
-		return bookmark, fmt.Errorf("Error retrieving site: %v", err)
+		return LinkCheck{}, err
 	}
-	// parse the html in the page and extract the title
-	doc, err := html.Parse(bytes.NewReader(page))
+	res, err := fetcher.client.Do(req)
 	if err != nil {
-		return
+		return LinkCheck{}, err
 	}
+	// the body isn't wanted
+	res.Body.Close()
 
-	htmlNode := findChild(doc, atom.Html)
-	if htmlNode == nil {
-		return
+	check := LinkCheck{Status: res.StatusCode}
+	if res.Request.URL.String() != req.URL.String() {
+		check.RedirectUrl = res.Request.URL.String()
+		// each request after the first carries the response that
+		// redirected to it
+		check.Permanent = true
+		for r := res.Request; r.Response != nil; r = r.Response.Request {
+			status := r.Response.StatusCode
+			if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+				check.Permanent = false
+			}
+		}
 	}
-	headNode := findChild(htmlNode, atom.Head)
-	if headNode == nil {
-		return
+	return check, nil
+}
+
+// Returns the value of the named attribute of an element
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
 	}
-	for n := headNode.FirstChild; n != nil; n = n.NextSibling {
-		if n.Type == html.ElementNode && n.DataAtom == atom.Title {
-			bookmark.Title = n.FirstChild.Data
-			break
+	return ""
+}
+
+// Icon urls tried for a page at most, so that a page declaring a great many
+// can't keep the fetcher busy
+const maxIconUrls = 3
+
+// Returns candidate icon urls for a page, most preferred first: icons the
+// page declares, then apple touch icons, then the conventional /favicon.ico,
+// which is always the last of at most maxIconUrls
+func iconUrls(headNode *html.Node, base *url.URL) []*url.URL {
+	var icons, touchIcons []*url.URL
+	if headNode != nil {
+		for n := headNode.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type != html.ElementNode || n.DataAtom != atom.Link {
+				continue
+			}
+			href, err := base.Parse(getAttr(n, "href"))
+			if err != nil || getAttr(n, "href") == "" {
+				continue
+			}
+			for _, rel := range strings.Fields(strings.ToLower(getAttr(n, "rel"))) {
+				if rel == "icon" {
+					icons = append(icons, href)
+					break
+				}
+				if rel == "apple-touch-icon" || rel == "apple-touch-icon-precomposed" {
+					touchIcons = append(touchIcons, href)
+					break
+				}
+			}
 		}
 	}
+	declared := append(icons, touchIcons...)
+	if len(declared) > maxIconUrls-1 {
+		declared = declared[:maxIconUrls-1]
+	}
+	favicon, _ := base.Parse("/favicon.ico")
+	return append(declared, favicon)
+}
+
+// Retrieves the first of the candidate icons that can be fetched and looks
+// like an image
+func (fetcher *FetcherImpl) fetchIcon(ctx context.Context, candidates []*url.URL) (icon []byte, iconType string) {
+	for _, candidate := range candidates {
+		if candidate.Scheme != "http" && candidate.Scheme != "https" {
+			continue
+		}
+		result, err := fetcher.fetch(ctx, candidate.String(), anyContent, true)
+		if err != nil || len(result.body) == 0 || result.truncated {
+			continue
+		}
+		iconType = result.contentType
+		if !strings.HasPrefix(iconType, "image/") {
+			// servers are frequently vague about icon types
+			iconType = http.DetectContentType(result.body)
+		}
+		if strings.HasPrefix(iconType, "image/") {
+			return result.body, iconType
+		}
+	}
+	return nil, ""
+}
+
+// Fetches a page and its icon, all within the fetcher's timeout
+func (fetcher *FetcherImpl) FetchBookmark(ctx context.Context, url string) (bookmark BookmarkData, err error) {
+	ctx, cancel := context.WithTimeout(ctx, fetcher.timeout)
+	defer cancel()
+	page, err := fetcher.fetch(ctx, url, htmlContent, false)
+	if err != nil {
+		return bookmark, fmt.Errorf("Error retrieving site: %w", err)
+	}
+	bookmark.FinalUrl = page.url.String()
+	if page.body == nil {
+		// not a web page, so there's no title to be had; the file name
+		// will have to do
+		bookmark.Title = path.Base(page.url.Path)
+		if bookmark.Title == "/" || bookmark.Title == "." {
+			bookmark.Title = ""
+		}
+		bookmark.Icon, bookmark.IconType = fetcher.fetchIcon(ctx, iconUrls(nil, page.url))
+		return
+	}
+	// a truncated page is still worth parsing, since the metadata we want
+	// is usually right at the top
+	// html.Parse expects utf-8, so transcode according to the charset in
+	// the content type, a byte order mark, or a <meta> tag in the page
+	reader, err := charset.NewReader(bytes.NewReader(page.body), page.contentType)
+	if err != nil {
+		return bookmark, fmt.Errorf("Error decoding site: %v", err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return bookmark, fmt.Errorf("Error decoding site: %v", err)
+	}
+	// the decoder passes a byte order mark through, which would otherwise be
+	// parsed as body text ahead of the <head>
+	decoded = bytes.TrimPrefix(decoded, []byte("\ufeff"))
+	// parse the html in the page and extract the title and friends
+	doc, err := html.Parse(bytes.NewReader(decoded))
+	if err != nil {
+		return
+	}
+	metadata := collectMetadata(doc)
+	extractMetadata(metadata, page.url, &bookmark)
+	bookmark.Icon, bookmark.IconType = fetcher.fetchIcon(ctx, iconUrls(metadata.head, page.url))
 	return
 }
@@ -2,10 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
 	"gotest.tools/assert"
 )
 
@@ -19,12 +32,15 @@ var titles = [...]string{
 	"Serious Eats",
 }
 
+// test servers listen on loopback, which the fetcher refuses by default
+var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
 func TestFetch(t *testing.T) {
 	if testing.Short() {
 		t.Skip()
 	}
 
-	fetcher, err := NewFetcher()
+	fetcher, err := NewFetcher(FetcherConfig{})
 	assert.NilError(t, err)
 
 	for _, url := range urls {
@@ -59,7 +75,7 @@ func TestFetchBookmark(t *testing.T) {
 		t.Skip()
 	}
 
-	fetcher, err := NewFetcher()
+	fetcher, err := NewFetcher(FetcherConfig{})
 	assert.NilError(t, err)
 
 	for idx, url := range urls {
@@ -75,3 +91,341 @@ func TestFetchBookmark(t *testing.T) {
 		t.Error("Failed to return error for invalid url")
 	}
 }
+
+// A png header, enough to be recognized by content sniffing
+var pngIcon = []byte("\x89PNG\x0D\x0A\x1A\x0Aicon")
+
+func TestFetchBookmarkIcon(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/declared", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>declared</title><link rel="Shortcut Icon" href="static/icon.png"></head></html>`))
+	})
+	mux.HandleFunc("/touch", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>touch</title><link rel="apple-touch-icon" href="/touch.png"></head></html>`))
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>broken</title><link rel="icon" href="/missing.png"></head></html>`))
+	})
+	mux.HandleFunc("/static/icon.png", func(w http.ResponseWriter, r *http.Request) {
+		// a vague content type should be sniffed
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(pngIcon)
+	})
+	mux.HandleFunc("/touch.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngIcon)
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/x-icon")
+		w.Write([]byte("favicon"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := NewFetcher(FetcherConfig{AllowedNetworks: loopback})
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	bookmark, err := fetcher.FetchBookmark(ctx, server.URL+"/declared")
+	assert.NilError(t, err)
+	assert.Equal(t, "declared", bookmark.Title)
+	assert.DeepEqual(t, pngIcon, bookmark.Icon)
+	assert.Equal(t, "image/png", bookmark.IconType)
+
+	bookmark, err = fetcher.FetchBookmark(ctx, server.URL+"/touch")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pngIcon, bookmark.Icon)
+	assert.Equal(t, "image/png", bookmark.IconType)
+
+	// falls back to favicon.ico
+	bookmark, err = fetcher.FetchBookmark(ctx, server.URL+"/broken")
+	assert.NilError(t, err)
+	assert.Equal(t, "broken", bookmark.Title)
+	assert.DeepEqual(t, []byte("favicon"), bookmark.Icon)
+	assert.Equal(t, "image/x-icon", bookmark.IconType)
+}
+
+func TestFetchBookmarkCharset(t *testing.T) {
+	encode := func(e interface{ NewEncoder() *encoding.Encoder }, s string) []byte {
+		b, err := e.NewEncoder().Bytes([]byte(s))
+		assert.NilError(t, err)
+		return b
+	}
+	utf16 := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	pages := []struct {
+		path        string
+		contentType string
+		body        []byte
+		title       string
+	}{
+		// charset from the content type
+		{"/header", "text/html; charset=windows-1252",
+			encode(charmap.Windows1252, "<html><head><title>Café “quoted”</title></head></html>"), "Café “quoted”"},
+		// charset from a meta tag
+		{"/meta", "text/html",
+			encode(japanese.ShiftJIS, `<html><head><meta charset="shift_jis"><title>日本語のページ</title></head></html>`), "日本語のページ"},
+		{"/http-equiv", "",
+			encode(charmap.ISO8859_2, `<html><head><meta http-equiv="Content-Type" content="text/html; charset=iso-8859-2"><title>Łódź</title></head></html>`), "Łódź"},
+		// charset from a byte order mark
+		{"/bom", "text/html",
+			encode(utf16, "<html><head><title>Ünïcödé</title></head></html>"), "Ünïcödé"},
+		// plain old utf-8
+		{"/utf8", "text/html; charset=utf-8",
+			[]byte("<html><head><title>Grüße</title></head></html>"), "Grüße"},
+	}
+
+	mux := http.NewServeMux()
+	for _, page := range pages {
+		mux.HandleFunc(page.path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", page.contentType)
+			w.Write(page.body)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := NewFetcher(FetcherConfig{AllowedNetworks: loopback})
+	assert.NilError(t, err)
+	for _, page := range pages {
+		bookmark, err := fetcher.FetchBookmark(context.Background(), server.URL+page.path)
+		assert.NilError(t, err)
+		assert.Equal(t, page.title, bookmark.Title, page.path)
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+	var downloadWritten, iconRequests atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/icons", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>icons</title>"))
+		for i := range 10 {
+			fmt.Fprintf(w, `<link rel="icon" href="/slow?icon=%d">`, i)
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>missing</title>"))
+		for i := range 10 {
+			fmt.Fprintf(w, `<link rel="icon" href="/none/%d.png">`, i)
+		}
+	})
+	mux.HandleFunc("/none/", func(w http.ResponseWriter, r *http.Request) {
+		iconRequests.Add(1)
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>big</title></head><body>"))
+		w.Write([]byte(strings.Repeat("<p>filler</p>", 10000)))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/files/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		chunk := make([]byte, 64<<10)
+		for range 1000 {
+			n, err := w.Write(chunk)
+			downloadWritten.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		// too big to be an icon
+		w.Header().Set("Content-Type", "image/x-icon")
+		w.Write(make([]byte, 4096))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := NewFetcher(FetcherConfig{
+		Timeout:         200 * time.Millisecond,
+		MaxBodyBytes:    1024,
+		MaxRedirects:    3,
+		AllowedNetworks: loopback,
+	})
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	var netErr net.Error
+	_, err = fetcher.FetchBookmark(ctx, server.URL+"/slow")
+	assert.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "%v", err)
+
+	// the timeout covers the icons as well as the page, and only a few of
+	// them are tried
+	start := time.Now()
+	bookmark, err := fetcher.FetchBookmark(ctx, server.URL+"/icons")
+	assert.NilError(t, err)
+	assert.Equal(t, "icons", bookmark.Title)
+	assert.Assert(t, time.Since(start) < time.Second)
+	bookmark, err = fetcher.FetchBookmark(ctx, server.URL+"/missing")
+	assert.NilError(t, err)
+	assert.Equal(t, int64(maxIconUrls-1), iconRequests.Load())
+
+	_, err = fetcher.FetchBookmark(ctx, server.URL+"/loop")
+	assert.ErrorContains(t, err, "stopped after 3 redirects")
+
+	// a page that is too big is truncated, but the title survives
+	body, err := fetcher.Fetch(ctx, server.URL+"/big")
+	assert.NilError(t, err)
+	assert.Equal(t, 1024, len(body))
+	bookmark, err = fetcher.FetchBookmark(ctx, server.URL+"/big")
+	assert.NilError(t, err)
+	assert.Equal(t, "big", bookmark.Title)
+	assert.Assert(t, bookmark.Icon == nil)
+
+	// something other than a page isn't downloaded
+	bookmark, err = fetcher.FetchBookmark(ctx, server.URL+"/files/report.pdf")
+	assert.NilError(t, err)
+	assert.Equal(t, "report.pdf", bookmark.Title)
+	assert.Assert(t, downloadWritten.Load() < 1000*64<<10)
+}
+
+func TestFetchPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>local</title></head></html>"))
+	})
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+
+	// without an allowance, the test server is off limits
+	fetcher, err := NewFetcher(FetcherConfig{})
+	assert.NilError(t, err)
+	var policyErr *PolicyError
+	for _, url := range []string{
+		server.URL,
+		strings.Replace(server.URL, "127.0.0.1", "localhost", 1),
+		"file:///etc/passwd",
+		"ftp://example.com/",
+		"http:///nohost",
+		"http://[::1]/",
+		"http://169.254.169.254/",
+		"http://10.0.0.1/",
+	} {
+		_, err = fetcher.FetchBookmark(ctx, url)
+		assert.Assert(t, errors.As(err, &policyErr), url)
+	}
+
+	// with one, the redirects are still checked
+	fetcher, err = NewFetcher(FetcherConfig{AllowedNetworks: loopback})
+	assert.NilError(t, err)
+	bookmark, err := fetcher.FetchBookmark(ctx, server.URL)
+	assert.NilError(t, err)
+	assert.Equal(t, "local", bookmark.Title)
+	_, err = fetcher.FetchBookmark(ctx, server.URL+"/metadata")
+	assert.Assert(t, errors.As(err, &policyErr))
+	_, err = fetcher.FetchBookmark(ctx, server.URL+"/file")
+	assert.Assert(t, errors.As(err, &policyErr))
+}
+
+func TestCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>ok</title></head></html>"))
+	})
+	mux.HandleFunc("/nohead", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte("<html><head><title>no head</title></head></html>"))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/found", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/chain", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/found", http.StatusPermanentRedirect)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := NewFetcher(FetcherConfig{AllowedNetworks: loopback})
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		path  string
+		check LinkCheck
+	}{
+		{"/ok", LinkCheck{Status: http.StatusOK}},
+		{"/nohead", LinkCheck{Status: http.StatusOK}},
+		{"/gone", LinkCheck{Status: http.StatusNotFound}},
+		{"/moved", LinkCheck{http.StatusOK, server.URL + "/ok", true}},
+		{"/found", LinkCheck{http.StatusOK, server.URL + "/ok", false}},
+		// only as permanent as the least permanent redirect
+		{"/chain", LinkCheck{http.StatusOK, server.URL + "/ok", false}},
+	} {
+		check, err := fetcher.Check(ctx, server.URL+test.path)
+		assert.NilError(t, err, test.path)
+		assert.Equal(t, test.check, check, test.path)
+	}
+
+	// no response at all is an error
+	closed := httptest.NewServer(mux)
+	closed.Close()
+	_, err = fetcher.Check(ctx, closed.URL+"/ok")
+	assert.ErrorContains(t, err, "connection refused")
+	var policyErr *PolicyError
+	_, err = fetcher.Check(ctx, "file:///etc/passwd")
+	assert.Assert(t, errors.As(err, &policyErr))
+}
+
+func TestFetchBookmarkFinalUrl(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/article?id=3", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>article</title><link rel="canonical" href="/articles/3"></head></html>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher, err := NewFetcher(FetcherConfig{AllowedNetworks: loopback})
+	assert.NilError(t, err)
+	bookmark, err := fetcher.FetchBookmark(context.Background(), server.URL+"/short")
+	assert.NilError(t, err)
+	assert.Equal(t, server.URL+"/article?id=3", bookmark.FinalUrl)
+	assert.Equal(t, server.URL+"/articles/3", bookmark.CanonicalUrl)
+	assert.Equal(t, server.URL+"/articles/3", bookmark.preferredUrl())
+}
+
+func TestPreferredUrl(t *testing.T) {
+	for _, test := range []struct {
+		canonical string
+		final     string
+		preferred string
+	}{
+		{"https://example.com/a", "https://example.com/a?id=1", "https://example.com/a"},
+		{"https://example.com/a", "https://www.example.com/a", "https://example.com/a"},
+		{"http://news.example.co.uk/a", "https://www.example.co.uk/a", "http://news.example.co.uk/a"},
+		{"http://127.0.0.1:8080/a", "http://127.0.0.1/a", "http://127.0.0.1:8080/a"},
+		// other sites, even under the same public suffix, don't count
+		{"https://bank.com/login", "https://example.com/a", "https://example.com/a"},
+		{"https://alice.github.io/a", "https://bob.github.io/a", "https://bob.github.io/a"},
+		{"http://127.0.0.2/a", "http://127.0.0.1/a", "http://127.0.0.1/a"},
+		{"ftp://example.com/a", "https://example.com/a", "https://example.com/a"},
+		{"", "https://example.com/a", "https://example.com/a"},
+		{"https://example.com/a", "", ""},
+	} {
+		bookmark := BookmarkData{CanonicalUrl: test.canonical, FinalUrl: test.final}
+		assert.Equal(t, test.preferred, bookmark.preferredUrl(), "%s from %s", test.canonical, test.final)
+	}
+}
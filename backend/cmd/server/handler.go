@@ -1,38 +1,118 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type bookmarkEntry struct {
-	Title      string `json:"title"`
-	Url        string `json:"url"`
-	IsFavorite bool   `json:"isFavorite"`
+	Title        string   `json:"title"`
+	Url          string   `json:"url"`
+	IsFavorite   bool     `json:"isFavorite"`
+	Tags         []string `json:"tags"`
+	Notes        string   `json:"notes"`
+	Description  string   `json:"description"`
+	CanonicalUrl string   `json:"canonicalUrl"`
+	SiteName     string   `json:"siteName"`
+	ImageUrl     string   `json:"imageUrl"`
+	Author       string   `json:"author"`
+	Status       string   `json:"status"`
+	// For search results, the title with the words that matched marked, and
+	// a snippet of the notes around the matches if there are notes
+	TitleHighlight *highlightedText `json:"titleHighlight,omitempty"`
+	Snippet        *highlightedText `json:"snippet,omitempty"`
+
+	// where it comes in a page of bookmarks
+	id      int64
+	sortKey any
 }
 
 type bookmarkList []bookmarkEntry
 
-func handler(db Db, fetcher Fetcher, port int, frontendPath string) {
+// Some text with the parts that matched a search marked, leaving it to the
+// client to display them safely
+type highlightedText struct {
+	Text    string       `json:"text"`
+	Matches []matchRange `json:"matches"`
+}
+
+// Where a match is in some text, counted in UTF-16 code units as
+// JavaScript strings are
+type matchRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type tagEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type tagList []tagEntry
+
+// Sets up the routes. Everything but the bundled assets needs
+// authentication, apart from the Pinboard api, which does its own.
+func newMux(db Db, fetcher Fetcher, queue *JobQueue, frontendPath string, pinboardToken string, authenticators []Authenticator) *http.ServeMux {
+	app := http.NewServeMux()
 	// Handle the api routes in the backend
-	http.Handle("POST /api/add", http.HandlerFunc(add(db, fetcher)))
-	http.Handle("GET /api/recents", http.HandlerFunc(fetchRecents(db)))
-	http.Handle("GET /api/favorites", http.HandlerFunc(fetchFavorites(db)))
-	http.Handle("GET /api/search", http.HandlerFunc(search(db)))
-	http.Handle("POST /api/hit", http.HandlerFunc(hit(db)))
-	http.Handle("POST /api/setFavorite", http.HandlerFunc(setFavorite(db)))
-	// bundled assets and static resources
-	http.Handle("GET /assets/", http.FileServer(http.Dir(frontendPath)))
-	http.Handle("GET /static/", http.FileServer(http.Dir(frontendPath)))
+	app.Handle("POST /api/add", http.HandlerFunc(add(db, fetcher, queue)))
+	app.Handle("GET /api/job", http.HandlerFunc(fetchJob(db)))
+	app.Handle("GET /api/recents", http.HandlerFunc(fetchRecents(db)))
+	app.Handle("GET /api/favorites", http.HandlerFunc(fetchFavorites(db)))
+	app.Handle("GET /api/search", http.HandlerFunc(search(db)))
+	app.Handle("GET /api/bookmarks", http.HandlerFunc(fetchBookmarks(db)))
+	app.Handle("POST /api/hit", http.HandlerFunc(hit(db)))
+	app.Handle("POST /api/setFavorite", http.HandlerFunc(setFavorite(db)))
+	app.Handle("DELETE /api/bookmark", http.HandlerFunc(deleteBookmark(db)))
+	app.Handle("PATCH /api/bookmark", http.HandlerFunc(updateBookmark(db)))
+	app.Handle("GET /api/bookmark/stats", http.HandlerFunc(fetchBookmarkStats(db)))
+	app.Handle("GET /api/history", http.HandlerFunc(fetchHistory(db)))
+	app.Handle("GET /api/links", http.HandlerFunc(fetchCheckedLinks(db)))
+	app.Handle("POST /api/links/follow", http.HandlerFunc(followRedirects(db)))
+	app.Handle("GET /api/duplicates", http.HandlerFunc(fetchDuplicates(db)))
+	app.Handle("POST /api/merge", http.HandlerFunc(mergeBookmarks(db)))
+	app.Handle("GET /api/tags", http.HandlerFunc(fetchTags(db)))
+	app.Handle("GET /api/tagged", http.HandlerFunc(fetchTagged(db)))
+	app.Handle("POST /api/tag", http.HandlerFunc(addTag(db)))
+	app.Handle("DELETE /api/tag", http.HandlerFunc(removeTag(db)))
+	app.Handle("GET /api/icon", http.HandlerFunc(fetchIcon(db)))
+	app.Handle("POST /api/import", http.HandlerFunc(importBookmarks(db)))
+	app.Handle("GET /api/export", http.HandlerFunc(exportBookmarks(db)))
 	// For other requests, serve up the frontend code
-	http.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+	app.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, fmt.Sprintf("%s/index.html", frontendPath))
 	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", requireAuth(authenticators, app))
+	// the Pinboard-compatible api
+	mux.Handle("/v1/posts/update", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardUpdateTime(db))))
+	mux.Handle("/v1/posts/add", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardAdd(db))))
+	mux.Handle("/v1/posts/delete", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardDelete(db))))
+	mux.Handle("/v1/posts/get", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardGet(db))))
+	mux.Handle("/v1/posts/recent", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardRecent(db))))
+	mux.Handle("/v1/posts/all", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardAll(db))))
+	mux.Handle("/v1/tags/get", http.HandlerFunc(pinboardAuth(db, pinboardToken, pinboardTagCounts(db))))
+	// bundled assets and static resources
+	mux.Handle("GET /assets/", http.FileServer(http.Dir(frontendPath)))
+	mux.Handle("GET /static/", http.FileServer(http.Dir(frontendPath)))
+	return mux
+}
+
+func handler(db Db, fetcher Fetcher, queue *JobQueue, port int, frontendPath string, pinboardToken string, authenticators []Authenticator) {
+	mux := newMux(db, fetcher, queue, frontendPath, pinboardToken, authenticators)
 	log.Println("server listening on port", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), mux))
 }
 
 func logError(w http.ResponseWriter, msg string, code int) {
@@ -40,67 +120,93 @@ func logError(w http.ResponseWriter, msg string, code int) {
 	http.Error(w, msg, code)
 }
 
-func search(db Db) func(http.ResponseWriter, *http.Request) {
+// Parses the optional count parameter, reporting an error to the client if
+// it is malformed
+func countParam(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	countStr, ok := r.URL.Query()["count"]
+	if !ok {
+		return def, true
+	}
+	count, err := strconv.Atoi(countStr[0])
+	if err != nil || count < 0 {
+		logError(w, fmt.Sprintf("Invalid count specification: %s", countStr[0]), http.StatusBadRequest)
+		return 0, false
+	}
+	return count, true
+}
+
+// Serves pages of bookmarks. Clients can search with q, order them with
+// sort, and ask for more than the first page with cursor.
+func listBookmarks(db Db, req PageRequest, defaultSort SortOrder, defaultCount int) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query, ok := r.URL.Query()["q"]
-		if !ok {
-			logError(w, "No search terms provided", http.StatusBadRequest)
+		params := r.URL.Query()
+		req := req
+		req.Query = params.Get("q")
+		req.Cursor = params.Get("cursor")
+		var err error
+		req.Sort, err = parseSort(params.Get("sort"), defaultSort)
+		if err != nil {
+			logError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		list, err := db.Search(r.Context(), query[0])
-		if err != nil {
-			logError(w, fmt.Sprintf("Error fetching recent bookmarks: %v", err), http.StatusInternalServerError)
+		var ok bool
+		req.Count, ok = countParam(w, r, defaultCount)
+		if !ok {
 			return
 		}
-		json.NewEncoder(w).Encode(list)
-		w.Header().Set("Content-Type", "application/json")
-	}
-}
 
-func fetchRecents(db Db) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		count := 5
-		countStr, ok := r.URL.Query()["count"]
-		if ok {
-			count, err = strconv.Atoi(countStr[0])
-			if err != nil {
-				logError(w, fmt.Sprintf("Invalid count specification: %s", countStr[0]), http.StatusBadRequest)
-				return
-			}
+		page, err := db.Page(r.Context(), req)
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			// tell the client what's wrong with the query, so it can show
+			// the user
+			log.Printf("%d %v", http.StatusBadRequest, queryErr)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(queryErr)
+			return
+		}
+		if errors.Is(err, ErrInvalidCursor) {
+			logError(w, fmt.Sprintf("Invalid cursor: %s", req.Cursor), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrUnpagedSort) {
+			logError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		recentList, err := db.Recents(r.Context(), count)
 		if err != nil {
-			logError(w, fmt.Sprintf("Error fetching recent bookmarks: %v", err), http.StatusInternalServerError)
+			logError(w, fmt.Sprintf("Error fetching bookmarks: %v", err), http.StatusInternalServerError)
 			return
 		}
-		json.NewEncoder(w).Encode(recentList)
 		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
-func fetchFavorites(db Db) func(http.ResponseWriter, *http.Request) {
+func search(db Db) func(http.ResponseWriter, *http.Request) {
+	list := listBookmarks(db, PageRequest{}, SortRelevance, 50)
 	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		count := 5
-		countStr, ok := r.URL.Query()["count"]
-		if ok {
-			count, err = strconv.Atoi(countStr[0])
-			if err != nil {
-				logError(w, fmt.Sprintf("Invalid count specification: %s", countStr[0]), http.StatusBadRequest)
-				return
-			}
-		}
-		recentList, err := db.Favorites(r.Context(), count)
-		if err != nil {
-			logError(w, fmt.Sprintf("Error fetching favorite bookmarks: %v", err), http.StatusInternalServerError)
+		if !r.URL.Query().Has("q") {
+			logError(w, "No search terms provided", http.StatusBadRequest)
 			return
 		}
-		json.NewEncoder(w).Encode(recentList)
-		w.Header().Set("Content-Type", "application/json")
+		list(w, r)
 	}
 }
 
+func fetchRecents(db Db) func(http.ResponseWriter, *http.Request) {
+	return listBookmarks(db, PageRequest{Titled: true}, SortRecent, 5)
+}
+
+func fetchFavorites(db Db) func(http.ResponseWriter, *http.Request) {
+	return listBookmarks(db, PageRequest{Favorites: true, Titled: true}, SortFrecency, 5)
+}
+
+// Browses every bookmark, newest first unless asked otherwise
+func fetchBookmarks(db Db) func(http.ResponseWriter, *http.Request) {
+	return listBookmarks(db, PageRequest{}, SortAdded, 50)
+}
+
 func hit(db Db) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		url, ok := r.URL.Query()["url"]
@@ -108,7 +214,10 @@ func hit(db Db) func(http.ResponseWriter, *http.Request) {
 			logError(w, "No url provided", http.StatusBadRequest)
 			return
 		}
-		err := db.Hit(r.Context(), url[0])
+		err := db.Hit(r.Context(), url[0], Visitor{
+			Client:    r.URL.Query().Get("client"),
+			UserAgent: r.UserAgent(),
+		})
 		if err != nil {
 			logError(w, fmt.Sprintf("Error updating database: %v", err), http.StatusInternalServerError)
 			return
@@ -143,7 +252,164 @@ func setFavorite(db Db) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func add(db Db, fetcher Fetcher) func(http.ResponseWriter, *http.Request) {
+func deleteBookmark(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		url, ok := r.URL.Query()["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		err := db.Delete(r.Context(), url[0])
+		if errors.Is(err, ErrNotFound) {
+			logError(w, fmt.Sprintf("No bookmark for %s", url[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error updating database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func updateBookmark(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		url, ok := query["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		var patch BookmarkPatch
+		if title, ok := query["title"]; ok {
+			patch.Title = &title[0]
+		}
+		if newUrl, ok := query["newUrl"]; ok {
+			if newUrl[0] == "" {
+				logError(w, "Empty newUrl provided", http.StatusBadRequest)
+				return
+			}
+			patch.Url = &newUrl[0]
+		}
+		if notes, ok := query["notes"]; ok {
+			patch.Notes = &notes[0]
+		}
+		err := db.Update(r.Context(), url[0], patch)
+		if errors.Is(err, ErrNotFound) {
+			logError(w, fmt.Sprintf("No bookmark for %s", url[0]), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrExists) {
+			logError(w, fmt.Sprintf("A bookmark already exists for %s", *patch.Url), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error updating database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func fetchTags(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tags, err := db.Tags(r.Context())
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tags)
+		w.Header().Set("Content-Type", "application/json")
+	}
+}
+
+func fetchTagged(db Db) func(http.ResponseWriter, *http.Request) {
+	list := listBookmarks(db, PageRequest{}, SortRecent, 5)
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if !params.Has("tag") {
+			logError(w, "No tag provided", http.StatusBadRequest)
+			return
+		}
+		tag, err := normalizeTag(params.Get("tag"))
+		// the query syntax has no way to quote a quote
+		if err != nil || strings.Contains(tag, `"`) {
+			logError(w, fmt.Sprintf("Invalid tag %q", params.Get("tag")), http.StatusBadRequest)
+			return
+		}
+		params.Set("q", strings.TrimSpace(`tag:"`+tag+`" `+params.Get("q")))
+		params.Del("tag")
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = params.Encode()
+		list(w, r)
+	}
+}
+
+// Returns a handler that applies the tag operation to the url and tag
+// named in the request
+func tagOp(op func(ctx context.Context, url string, tag string) error) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		url, ok := r.URL.Query()["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		tag, ok := r.URL.Query()["tag"]
+		if !ok {
+			logError(w, "No tag provided", http.StatusBadRequest)
+			return
+		}
+		err := op(r.Context(), url[0], tag[0])
+		if errors.Is(err, ErrInvalidTag) {
+			logError(w, fmt.Sprintf("Invalid tag %q", tag[0]), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			logError(w, fmt.Sprintf("%v: %s", err, url[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error updating database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func addTag(db Db) func(http.ResponseWriter, *http.Request) {
+	return tagOp(db.AddTag)
+}
+
+func removeTag(db Db) func(http.ResponseWriter, *http.Request) {
+	return tagOp(db.RemoveTag)
+}
+
+func fetchIcon(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		url, ok := r.URL.Query()["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		icon, err := db.Icon(r.Context(), url[0])
+		if errors.Is(err, ErrNotFound) {
+			// plenty of sites have no icon, so this isn't worth logging
+			http.Error(w, fmt.Sprintf("No icon for %s", url[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching icon: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", icon.ContentType)
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+		w.Header().Set("ETag", `"`+icon.Hash+`"`)
+		// icons are third-party content, so don't let them sniff their way
+		// into being something other than an image, or run scripts if svg
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(icon.Data))
+	}
+}
+
+func add(db Db, fetcher Fetcher, queue *JobQueue) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		ctx := r.Context()
@@ -153,23 +419,149 @@ func add(db Db, fetcher Fetcher) func(http.ResponseWriter, *http.Request) {
 			logError(w, fmt.Sprintf("No url provided in request %v", r.URL), http.StatusBadRequest)
 			return
 		}
-		url := urls[0]
-		doUpdate := false
-		bookmarkData, ok := db.Get(ctx, url)
-		if !ok {
-			log.Println("fetching bookmark", url)
-			doUpdate = true
-			bookmarkData, err = fetcher.FetchBookmark(ctx, url)
-			if err != nil {
-				logError(w, fmt.Sprintf("Error retrieving site: %v", err), http.StatusBadRequest)
-				return
-			}
+		url := db.NormalizeUrl(urls[0])
+		notes := ""
+		notesParam, hasNotes := r.URL.Query()["notes"]
+		if hasNotes {
+			notes = notesParam[0]
 		}
-		if doUpdate {
-			err = db.Insert(ctx, url, bookmarkData)
-			if err != nil {
-				log.Printf("Error inserting into db: %v", err)
+		_, ok = db.Get(ctx, url)
+		if ok {
+			if hasNotes {
+				err = db.Update(ctx, url, BookmarkPatch{Notes: &notes})
+				if err != nil {
+					log.Printf("Error updating notes in db: %v", err)
+				}
 			}
+			return
+		}
+
+		// refuse forbidden urls now rather than leaving a failed job behind
+		err = fetcher.Allowed(ctx, url)
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			logError(w, policyErr.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error checking url: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// the page decides where it lives, if the caller would rather
+		canonical := r.URL.Query().Get("canonical") == "true"
+		job, err := queue.Add(ctx, url, notes, canonical)
+		if errors.Is(err, ErrExists) {
+			// someone else got there first
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error inserting into db: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+func fetchJob(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr, ok := r.URL.Query()["id"]
+		if !ok {
+			logError(w, "No id provided", http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseInt(idStr[0], 10, 64)
+		if err != nil {
+			logError(w, fmt.Sprintf("Invalid id specification: %s", idStr[0]), http.StatusBadRequest)
+			return
+		}
+		job, err := db.Job(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			logError(w, fmt.Sprintf("No job %d", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching job: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// Largest bookmark file accepted for import
+const maxImportBytes = 64 << 20
+
+// Returns the uploaded file, which may be sent either as the file field of
+// a multipart form or as the entire request body
+func uploadedFile(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	file, _, err := r.FormFile("file")
+	return file, err
+}
+
+func importBookmarks(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "netscape" && format != "json" {
+			logError(w, fmt.Sprintf("Unsupported import format: %s", format), http.StatusBadRequest)
+			return
+		}
+		mode, err := parseRestoreMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			logError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := uploadedFile(w, r)
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		var summary importSummary
+		if format == "json" {
+			summary, err = importDump(r.Context(), db, file, mode)
+		} else {
+			summary, err = importNetscape(r.Context(), db, file)
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error importing bookmarks: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.Println("import:", summary)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+func exportBookmarks(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "netscape":
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.html"`)
+			err = exportNetscape(r.Context(), db, w)
+		case "json":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.jsonl"`)
+			err = exportDump(r.Context(), db, w)
+		default:
+			logError(w, fmt.Sprintf("Unsupported export format: %s", format), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			// too late to change the status, so drop the connection
+			// rather than leave what looks like a complete file
+			log.Printf("Error exporting bookmarks: %v", err)
+			panic(http.ErrAbortHandler)
 		}
 	}
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"gotest.tools/assert"
@@ -19,8 +23,20 @@ func (*mockFetcher) Fetch(_ context.Context, url string) ([]byte, error) {
 	return []byte("<html><head><title>title for " + url + "</title></head></html>"), nil
 }
 
+func (*mockFetcher) Allowed(_ context.Context, url string) error {
+	return nil
+}
+
+func (*mockFetcher) Check(_ context.Context, url string) (LinkCheck, error) {
+	return LinkCheck{Status: http.StatusOK}, nil
+}
+
 func (*mockFetcher) FetchBookmark(_ context.Context, url string) (BookmarkData, error) {
-	return BookmarkData{Title: "title for " + url + "</title></head></html>"}, nil
+	return BookmarkData{
+		Title:    "title for " + url + "</title></head></html>",
+		Icon:     []byte("icon for " + url),
+		IconType: "image/x-icon",
+	}, nil
 }
 
 type titleStruct struct {
@@ -34,17 +50,57 @@ type bookmarkListEntryStruct struct {
 
 type bookmarkListStruct []bookmarkListEntryStruct
 
+type bookmarkPageStruct struct {
+	Items      bookmarkListStruct `json:"items"`
+	NextCursor string             `json:"nextCursor"`
+	Total      int                `json:"total"`
+}
+
 var testFetcher = &mockFetcher{}
 
-func addTest(t *testing.T, db Db, reqUrl string) {
+func addTest(t *testing.T, db Db, reqUrl string, expStatus int) {
 	v := url.Values{}
 	v.Add("url", reqUrl)
+	addValuesTest(t, db, v, expStatus)
+}
+
+func addValuesTest(t *testing.T, db Db, v url.Values, expStatus int) {
+	addFetcherTest(t, db, testFetcher, v, expStatus)
+}
+
+// Adds a bookmark and then runs the fetch job, if one was queued
+func addFetcherTest(t *testing.T, db Db, fetcher Fetcher, v url.Values, expStatus int) {
+	queue := NewJobQueue(db, fetcher, JobQueueConfig{})
 	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/add?%s", v.Encode()), nil)
 	w := httptest.NewRecorder()
-	add(db, testFetcher)(w, req)
+	add(db, fetcher, queue)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, expStatus)
+
+	if resp.StatusCode == http.StatusAccepted {
+		var job Job
+		err := json.NewDecoder(resp.Body).Decode(&job)
+		assert.NilError(t, err)
+		assert.Equal(t, db.NormalizeUrl(v.Get("url")), job.Url)
+		assert.Equal(t, "queued", job.State)
+		assert.NilError(t, drainQueue(queue))
+		jobTest(t, db, job.Id, "done")
+	}
+}
+
+func jobTest(t *testing.T, db Db, id int64, expState string) {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/job?id=%d", id), nil)
+	w := httptest.NewRecorder()
+	fetchJob(db)(w, req)
 	resp := w.Result()
 	defer resp.Body.Close()
 	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	var job Job
+	err := json.NewDecoder(resp.Body).Decode(&job)
+	assert.NilError(t, err)
+	assert.Equal(t, expState, job.State)
 }
 
 func listTest(t *testing.T, handler func(http.ResponseWriter, *http.Request), reqName string, reqCount int, expCount int, resultList *bookmarkListStruct) {
@@ -54,12 +110,12 @@ func listTest(t *testing.T, handler func(http.ResponseWriter, *http.Request), re
 	resp := w.Result()
 	defer resp.Body.Close()
 
-	var bookmarkList bookmarkListStruct
-	err := json.NewDecoder(resp.Body).Decode(&bookmarkList)
+	var page bookmarkPageStruct
+	err := json.NewDecoder(resp.Body).Decode(&page)
 	assert.NilError(t, err)
-	assert.Equal(t, expCount, len(bookmarkList))
+	assert.Equal(t, expCount, len(page.Items))
 	if resultList != nil {
-		*resultList = bookmarkList
+		*resultList = page.Items
 	}
 }
 
@@ -70,10 +126,26 @@ func searchTest(t *testing.T, db Db, pattern string, expCount int) {
 	resp := w.Result()
 	defer resp.Body.Close()
 
-	var bookmarkList bookmarkListStruct
-	err := json.NewDecoder(resp.Body).Decode(&bookmarkList)
+	var page bookmarkPageStruct
+	err := json.NewDecoder(resp.Body).Decode(&page)
 	assert.NilError(t, err)
-	assert.Equal(t, expCount, len(bookmarkList))
+	assert.Equal(t, expCount, len(page.Items))
+	assert.Equal(t, expCount, page.Total)
+}
+
+func TestSearchHandlerBadQuery(t *testing.T) {
+	db := setupTest(t)
+	req := httptest.NewRequest(http.MethodGet, "/search?q="+url.QueryEscape(`food "dinner`), nil)
+	w := httptest.NewRecorder()
+	search(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var queryErr QueryError
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&queryErr))
+	assert.Equal(t, QueryError{"unterminated quote", 5}, queryErr)
 }
 
 func isFavoriteTest(t *testing.T, db Db, urlstr string, isFavorite string) {
@@ -102,19 +174,173 @@ func hitTest(t *testing.T, db Db, urlstr string) {
 	assert.Equal(t, resp.StatusCode, http.StatusOK)
 }
 
+func deleteTest(t *testing.T, db Db, urlstr string, expStatus int) {
+	v := url.Values{}
+	v.Add("url", urlstr)
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/bookmark?%s", v.Encode()), nil)
+	w := httptest.NewRecorder()
+	deleteBookmark(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, expStatus)
+}
+
+func updateTest(t *testing.T, db Db, v url.Values, expStatus int) {
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/bookmark?%s", v.Encode()), nil)
+	w := httptest.NewRecorder()
+	updateBookmark(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, expStatus)
+}
+
+func tagTest(t *testing.T, db Db, method string, urlstr string, tag string, expStatus int) {
+	v := url.Values{}
+	v.Add("url", urlstr)
+	v.Add("tag", tag)
+	req := httptest.NewRequest(method, fmt.Sprintf("/tag?%s", v.Encode()), nil)
+	w := httptest.NewRecorder()
+	if method == http.MethodDelete {
+		removeTag(db)(w, req)
+	} else {
+		addTag(db)(w, req)
+	}
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, expStatus)
+}
+
+func tagsTest(t *testing.T, db Db, expTags tagList) {
+	req := httptest.NewRequest(http.MethodGet, "/tags", nil)
+	w := httptest.NewRecorder()
+	fetchTags(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	var tags tagList
+	err := json.NewDecoder(resp.Body).Decode(&tags)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, expTags, tags)
+}
+
+func taggedTest(t *testing.T, db Db, params url.Values, expStatus int, expCount int) bookmarkPageStruct {
+	req := httptest.NewRequest(http.MethodGet, "/tagged?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	fetchTagged(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	var page bookmarkPageStruct
+	assert.Equal(t, expStatus, resp.StatusCode)
+	if expStatus != http.StatusOK {
+		return page
+	}
+	err := json.NewDecoder(resp.Body).Decode(&page)
+	assert.NilError(t, err)
+	assert.Equal(t, expCount, len(page.Items))
+	return page
+}
+
+func iconTest(t *testing.T, db Db, urlstr string, etag string, expStatus int) string {
+	v := url.Values{}
+	v.Add("url", urlstr)
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/icon?%s", v.Encode()), nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	fetchIcon(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, expStatus)
+	if expStatus == http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, "icon for "+urlstr, string(body))
+		assert.Equal(t, "image/x-icon", resp.Header.Get("Content-Type"))
+		assert.Assert(t, resp.Header.Get("Cache-Control") != "")
+	}
+	return resp.Header.Get("ETag")
+}
+
+func importTest(t *testing.T, db Db, body io.Reader, contentType string, expImported int) {
+	req := httptest.NewRequest(http.MethodPost, "/import?format=netscape", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	importBookmarks(db)(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	var summary importSummary
+	err := json.NewDecoder(resp.Body).Decode(&summary)
+	assert.NilError(t, err)
+	assert.Equal(t, expImported, summary.Imported)
+}
+
+func TestImportHandler(t *testing.T) {
+	db, err := NewTestDb()
+	assert.NilError(t, err)
+
+	// as a plain body
+	importTest(t, db, strings.NewReader(`<DL><DT><A HREF="https://example.com/one">One</A></DL>`), "text/html", 1)
+
+	// as a form upload
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "bookmarks.html")
+	assert.NilError(t, err)
+	_, err = part.Write([]byte(`<DL><DT><A HREF="https://example.com/one">One</A><DT><A HREF="https://example.com/two">Two</A></DL>`))
+	assert.NilError(t, err)
+	assert.NilError(t, form.Close())
+	importTest(t, db, &body, form.FormDataContentType(), 1)
+
+	listTest(t, fetchRecents(db), "recent", 5, 2, nil)
+}
+
+func TestExportHandler(t *testing.T) {
+	db, err := NewTestDb()
+	assert.NilError(t, err)
+	assert.NilError(t, db.Insert(context.Background(), "https://example.com/one", BookmarkData{Title: "One"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/export?format=netscape", nil)
+	w := httptest.NewRecorder()
+	exportBookmarks(db)(w, req)
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=UTF-8", resp.Header.Get("Content-Type"))
+	assert.Assert(t, strings.Contains(w.Body.String(), `<A HREF="https://example.com/one"`))
+
+	req = httptest.NewRequest(http.MethodGet, "/export?format=csv", nil)
+	w = httptest.NewRecorder()
+	exportBookmarks(db)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
 // TODO: test something other than the happy path
 func TestHandlers(t *testing.T) {
 	db, err := NewTestDb()
 	assert.NilError(t, err)
 
 	// basic add request
-	addTest(t, db, urls[0])
+	addTest(t, db, urls[0], http.StatusAccepted)
 
 	// repeating test should produce same result but hit db
-	addTest(t, db, urls[0])
+	addTest(t, db, urls[0], http.StatusOK)
 
 	// set up a second title in the db
-	addTest(t, db, urls[1])
+	addTest(t, db, urls[1], http.StatusAccepted)
+
+	// icons are served with validators
+	etag := iconTest(t, db, urls[0], "", http.StatusOK)
+	iconTest(t, db, urls[0], etag, http.StatusNotModified)
+	iconTest(t, db, "http://foo.com", "", http.StatusNotFound)
+
+	// the real fetcher won't go poking around the local network
+	fetcher, err := NewFetcher(FetcherConfig{})
+	assert.NilError(t, err)
+	addFetcherTest(t, db, fetcher, url.Values{"url": {"http://127.0.0.1:1/"}}, http.StatusForbidden)
+	addFetcherTest(t, db, fetcher, url.Values{"url": {"file:///etc/passwd"}}, http.StatusForbidden)
 
 	// ask for five recents, expect two
 	listTest(t, fetchRecents(db), "recent", 5, 2, nil)
@@ -161,4 +387,59 @@ func TestHandlers(t *testing.T) {
 
 	// should have no search hits
 	searchTest(t, db, "foo", 0)
+
+	// tag both, one twice
+	tagTest(t, db, http.MethodPost, urls[0], "search", http.StatusOK)
+	tagTest(t, db, http.MethodPost, urls[1], "cooking", http.StatusOK)
+	tagTest(t, db, http.MethodPost, urls[1], "search", http.StatusOK)
+	tagTest(t, db, http.MethodPost, urls[1], "bad tag", http.StatusBadRequest)
+	tagTest(t, db, http.MethodPost, "http://foo.com", "search", http.StatusNotFound)
+	tagsTest(t, db, tagList{{"cooking", 1}, {"search", 2}})
+	page := taggedTest(t, db, url.Values{"tag": {"Search"}}, http.StatusOK, 2)
+	assert.Equal(t, 2, page.Total)
+	taggedTest(t, db, url.Values{"tag": {"cooking"}}, http.StatusOK, 1)
+	taggedTest(t, db, url.Values{"tag": {"bad tag"}}, http.StatusBadRequest, 0)
+	taggedTest(t, db, url.Values{}, http.StatusBadRequest, 0)
+	taggedTest(t, db, url.Values{"tag": {"search"}, "q": {"site:"}}, http.StatusBadRequest, 0)
+	taggedTest(t, db, url.Values{"tag": {"search"}, "sort": {"sideways"}}, http.StatusBadRequest, 0)
+
+	// a page at a time, in the order asked for
+	page = taggedTest(t, db, url.Values{"tag": {"search"}, "count": {"1"}, "sort": {"alphabetical"}}, http.StatusOK, 1)
+	assert.Equal(t, 2, page.Total)
+	first := page.Items[0].Url
+	page = taggedTest(t, db, url.Values{"tag": {"search"}, "count": {"1"}, "sort": {"alphabetical"}, "cursor": {page.NextCursor}}, http.StatusOK, 1)
+	assert.Assert(t, page.Items[0].Url != first)
+	assert.Equal(t, "", page.NextCursor)
+	searchTest(t, db, "cooking", 1)
+
+	// untag one
+	tagTest(t, db, http.MethodDelete, urls[1], "search", http.StatusOK)
+	tagTest(t, db, http.MethodDelete, urls[1], "search", http.StatusNotFound)
+	taggedTest(t, db, url.Values{"tag": {"search"}}, http.StatusOK, 1)
+
+	// retitle one of the two
+	updateTest(t, db, url.Values{"url": {urls[1]}, "title": {"delicious food"}}, http.StatusOK)
+	searchTest(t, db, "food", 1)
+
+	// annotate the other, both through edit and through add
+	updateTest(t, db, url.Values{"url": {urls[0]}, "notes": {"everything"}}, http.StatusOK)
+	searchTest(t, db, "everything", 1)
+	addValuesTest(t, db, url.Values{"url": {urls[0]}, "notes": {"nothing"}}, http.StatusOK)
+	searchTest(t, db, "everything", 0)
+	searchTest(t, db, "nothing", 1)
+
+	// moving it onto the other should fail
+	updateTest(t, db, url.Values{"url": {urls[1]}, "newUrl": {urls[0]}}, http.StatusConflict)
+
+	// updating something that isn't there should fail
+	updateTest(t, db, url.Values{"url": {"http://foo.com"}, "title": {"foo"}}, http.StatusNotFound)
+
+	// delete one of the two
+	deleteTest(t, db, urls[0], http.StatusOK)
+	listTest(t, fetchRecents(db), "recent", 5, 1, nil)
+	searchTest(t, db, "www", 0)
+	searchTest(t, db, "food", 1)
+
+	// deleting it again should fail
+	deleteTest(t, db, urls[0], http.StatusNotFound)
 }
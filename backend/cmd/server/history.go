@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// One time a bookmark was opened
+type Visit struct {
+	Url       string    `json:"url"`
+	Title     string    `json:"title"`
+	Visited   time.Time `json:"visited"`
+	Client    string    `json:"client,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+
+	id int64
+}
+
+// Asks for a page of visits
+type HistoryRequest struct {
+	// Visits from this time, and before To, with zero times leaving the
+	// range open at that end
+	From time.Time
+	To   time.Time
+	// Where the previous page left off, or "" for the first page
+	Cursor string
+	Count  int
+}
+
+// A page of visits, as with Page
+type HistoryPage struct {
+	Items      []Visit `json:"items"`
+	NextCursor string  `json:"nextCursor"`
+	Total      int     `json:"total"`
+}
+
+// The order of visits, for cursors
+const historyOrder SortOrder = "visited"
+
+// How much a bookmark has been used
+type BookmarkStats struct {
+	Url         string     `json:"url"`
+	Added       time.Time  `json:"added"`
+	LastVisited *time.Time `json:"lastVisited"`
+	// Every time it was opened, including from before visits were recorded
+	VisitCount int `json:"visitCount"`
+	// The recorded visits by week, leaving out weeks without any
+	Weeks []WeekVisits `json:"weeks"`
+}
+
+type WeekVisits struct {
+	// The Monday starting the week, as 2006-01-02
+	Week   string `json:"week"`
+	Visits int    `json:"visits"`
+}
+
+// Parses a time parameter, which can be a date or a full RFC 3339 time. A
+// date on its own means the start of the day, or with end, the start of the
+// next day, so that it takes in the whole of the day.
+func timeParam(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err == nil {
+		if end {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func fetchHistory(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		var req HistoryRequest
+		var err error
+		req.From, err = timeParam(params.Get("from"), false)
+		if err != nil {
+			logError(w, fmt.Sprintf("Invalid from time: %s", params.Get("from")), http.StatusBadRequest)
+			return
+		}
+		req.To, err = timeParam(params.Get("to"), true)
+		if err != nil {
+			logError(w, fmt.Sprintf("Invalid to time: %s", params.Get("to")), http.StatusBadRequest)
+			return
+		}
+		req.Cursor = params.Get("cursor")
+		var ok bool
+		req.Count, ok = countParam(w, r, 50)
+		if !ok {
+			return
+		}
+
+		page, err := db.History(r.Context(), req)
+		if errors.Is(err, ErrInvalidCursor) {
+			logError(w, fmt.Sprintf("Invalid cursor: %s", req.Cursor), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+func fetchBookmarkStats(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		url, ok := r.URL.Query()["url"]
+		if !ok {
+			logError(w, "No url provided", http.StatusBadRequest)
+			return
+		}
+		stats, err := db.Stats(r.Context(), url[0])
+		if errors.Is(err, ErrNotFound) {
+			logError(w, fmt.Sprintf("No bookmark for %s", url[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching bookmark stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestHistory(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://a.com", BookmarkData{Title: "a"}))
+	assert.NilError(t, db.Insert(ctx, "http://b.com", BookmarkData{Title: "b"}))
+	assert.NilError(t, db.Insert(withUser(ctx, "bob"), "http://a.com", BookmarkData{Title: "bob's a"}))
+	_, err := db.db.Exec(`INSERT INTO visits (bookmark, visited) SELECT id, v.visited FROM bookmarks,
+			(SELECT '2025-03-03 09:00:00' AS visited UNION SELECT '2025-03-04 12:00:00' UNION SELECT '2025-03-11 08:00:00')
+			AS v WHERE owner = 1 AND url = 'http://a.com'`)
+	assert.NilError(t, err)
+	_, err = db.db.Exec(`INSERT INTO visits (bookmark, visited) SELECT id, '2025-03-04 18:00:00' FROM bookmarks WHERE url = 'http://b.com'`)
+	assert.NilError(t, err)
+
+	// through the handler, which notes what did the visiting
+	req := httptest.NewRequest(http.MethodPost, "/hit?client=extension&url="+url.QueryEscape("http://b.com"), nil)
+	req.Header.Set("User-Agent", "Firefox")
+	hit(db)(httptest.NewRecorder(), req)
+
+	page, err := db.History(ctx, HistoryRequest{Count: 10})
+	assert.NilError(t, err)
+	// bob's visits aren't counted
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, "http://b.com", page.Items[0].Url)
+	assert.Equal(t, "extension", page.Items[0].Client)
+	assert.Equal(t, "Firefox", page.Items[0].UserAgent)
+
+	// what was used on the fourth, a page at a time
+	from, err := timeParam("2025-03-04", false)
+	assert.NilError(t, err)
+	to, err := timeParam("2025-03-04", true)
+	assert.NilError(t, err)
+	page, err = db.History(ctx, HistoryRequest{From: from, To: to, Count: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, "http://b.com", page.Items[0].Url)
+	assert.Equal(t, time.Date(2025, 3, 4, 18, 0, 0, 0, time.UTC), page.Items[0].Visited)
+	page, err = db.History(ctx, HistoryRequest{From: from, To: to, Count: 1, Cursor: page.NextCursor})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "http://a.com", page.Items[0].Url)
+	assert.Equal(t, "", page.NextCursor)
+
+	stats, err := db.Stats(ctx, "http://a.com")
+	assert.NilError(t, err)
+	assert.Equal(t, time.Date(2025, 3, 11, 8, 0, 0, 0, time.UTC), *stats.LastVisited)
+	assert.DeepEqual(t, []WeekVisits{{"2025-03-03", 2}, {"2025-03-10", 1}}, stats.Weeks)
+	stats, err = db.Stats(withUser(ctx, "bob"), "http://a.com")
+	assert.NilError(t, err)
+	assert.Assert(t, stats.LastVisited == nil)
+	assert.Equal(t, 0, len(stats.Weeks))
+	_, err = db.Stats(ctx, "http://c.com")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestHistoryHandlers(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	assert.NilError(t, db.Insert(ctx, "http://a.com", BookmarkData{Title: "a"}))
+	for range 3 {
+		assert.NilError(t, db.Hit(ctx, "http://a.com", Visitor{}))
+	}
+
+	get := func(handler func(http.ResponseWriter, *http.Request), path string, expStatus int, result any) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, expStatus, resp.StatusCode)
+		if result != nil {
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(result))
+		}
+	}
+
+	var page HistoryPage
+	get(fetchHistory(db), "/api/history?count=2&from="+time.Now().UTC().Format(time.DateOnly), http.StatusOK, &page)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 2, len(page.Items))
+	assert.Assert(t, page.NextCursor != "")
+	get(fetchHistory(db), "/api/history?to=2000-01-01", http.StatusOK, &page)
+	assert.Equal(t, 0, page.Total)
+	get(fetchHistory(db), "/api/history?from=yesterday", http.StatusBadRequest, nil)
+
+	var stats BookmarkStats
+	get(fetchBookmarkStats(db), "/api/bookmark/stats?url="+url.QueryEscape("http://a.com"), http.StatusOK, &stats)
+	assert.Equal(t, 3, stats.VisitCount)
+	assert.Equal(t, 1, len(stats.Weeks))
+	assert.Equal(t, 3, stats.Weeks[0].Visits)
+	assert.Assert(t, !stats.Added.IsZero())
+	get(fetchBookmarkStats(db), "/api/bookmark/stats?url="+url.QueryEscape("http://b.com"), http.StatusNotFound, nil)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// A background fetch of a bookmarked page
+type Job struct {
+	Id          int64     `json:"id"`
+	Url         string    `json:"url"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Settings for the fetch queue. Zero values are replaced by defaults.
+type JobQueueConfig struct {
+	// Number of fetches run at once
+	Workers int
+	// Fetches given up on after this many failures
+	MaxAttempts int
+	// Delay before the first retry, doubling with each one after
+	RetryDelay time.Duration
+	// Longest delay between retries
+	MaxRetryDelay time.Duration
+	// How often idle workers look for jobs whose retry time has come
+	PollInterval time.Duration
+}
+
+var defaultJobQueueConfig = JobQueueConfig{
+	Workers:       2,
+	MaxAttempts:   5,
+	RetryDelay:    30 * time.Second,
+	MaxRetryDelay: time.Hour,
+	PollInterval:  10 * time.Second,
+}
+
+// Fetches newly-added bookmarks in the background. The queue itself lives
+// in the database, so jobs survive a restart.
+type JobQueue struct {
+	db      Db
+	fetcher Fetcher
+	config  JobQueueConfig
+	wake    chan struct{}
+}
+
+func NewJobQueue(db Db, fetcher Fetcher, config JobQueueConfig) *JobQueue {
+	if config.Workers <= 0 {
+		config.Workers = defaultJobQueueConfig.Workers
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultJobQueueConfig.MaxAttempts
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultJobQueueConfig.RetryDelay
+	}
+	if config.MaxRetryDelay <= 0 {
+		config.MaxRetryDelay = defaultJobQueueConfig.MaxRetryDelay
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultJobQueueConfig.PollInterval
+	}
+	return &JobQueue{db, fetcher, config, make(chan struct{}, 1)}
+}
+
+// Stores a bookmark right away and queues a fetch to fill in its details,
+// and with canonical, to move it to the page's canonical url
+func (queue *JobQueue) Add(ctx context.Context, url string, notes string, canonical bool) (Job, error) {
+	job, err := queue.db.AddPending(ctx, url, BookmarkData{Notes: notes}, canonical)
+	if err != nil {
+		return Job{}, err
+	}
+	// nudge an idle worker, if there is one
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Starts the workers, after requeuing any jobs that a previous run of the
+// server left unfinished. The workers stop when the context is done.
+func (queue *JobQueue) Start(ctx context.Context) error {
+	err := queue.db.ResetJobs(ctx)
+	if err != nil {
+		return err
+	}
+	for range queue.config.Workers {
+		go queue.work(ctx)
+	}
+	return nil
+}
+
+func (queue *JobQueue) work(ctx context.Context) {
+	ticker := time.NewTicker(queue.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		ran, err := queue.runOne(ctx)
+		if err != nil {
+			log.Printf("Error running fetch job: %v", err)
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Runs the next ready job, if any, reporting whether there was one
+func (queue *JobQueue) runOne(ctx context.Context) (bool, error) {
+	job, ok, err := queue.db.ClaimJob(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	log.Println("fetching bookmark", job.Url)
+	bookmark, err := queue.fetcher.FetchBookmark(ctx, job.Url)
+	if err == nil {
+		return true, queue.db.CompleteJob(ctx, job.Id, bookmark)
+	}
+
+	// there's no point retrying something the policy forbids
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) || job.Attempts >= queue.config.MaxAttempts {
+		log.Printf("Giving up fetching %s after %d attempts: %v", job.Url, job.Attempts, err)
+		return true, queue.db.FailJob(ctx, job.Id, err.Error())
+	}
+	return true, queue.db.RetryJob(ctx, job.Id, err.Error(), queue.retryDelay(job.Attempts))
+}
+
+// Returns the delay before retrying a job, doubling with each attempt
+func (queue *JobQueue) retryDelay(attempts int) time.Duration {
+	delay := queue.config.RetryDelay
+	for i := 1; i < attempts && delay < queue.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, queue.config.MaxRetryDelay)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Runs jobs until there are none ready
+func drainQueue(queue *JobQueue) error {
+	for {
+		ran, err := queue.runOne(context.Background())
+		if err != nil || !ran {
+			return err
+		}
+	}
+}
+
+// Fails a set number of times for each url before succeeding
+type flakyFetcher struct {
+	mockFetcher
+	mu       sync.Mutex
+	failures map[string]int
+	err      error
+}
+
+func (f *flakyFetcher) FetchBookmark(ctx context.Context, url string) (BookmarkData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures[url] > 0 {
+		f.failures[url]--
+		return BookmarkData{}, f.err
+	}
+	return f.mockFetcher.FetchBookmark(ctx, url)
+}
+
+// Makes every queued job ready to run now, rather than waiting out its delay
+func expireDelays(t *testing.T, db *DbContext) {
+	_, err := db.db.Exec("UPDATE jobs SET nextAttempt = datetime('now') WHERE state = 'queued'")
+	assert.NilError(t, err)
+}
+
+func TestJobRetries(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	fetcher := &flakyFetcher{
+		failures: map[string]int{"http://example.com": 2, "http://example2.com": 10},
+		err:      errors.New("temporarily broken"),
+	}
+	queue := NewJobQueue(db, fetcher, JobQueueConfig{MaxAttempts: 3, RetryDelay: time.Minute})
+
+	job, err := queue.Add(ctx, "http://example.com", "some notes", false)
+	assert.NilError(t, err)
+	job2, err := queue.Add(ctx, "http://example2.com", "", false)
+	assert.NilError(t, err)
+	_, err = queue.Add(ctx, "http://example.com", "", false)
+	assert.Assert(t, errors.Is(err, ErrExists))
+
+	// the bookmark is there straight away, pending
+	recents, err := db.Recents(ctx, 5)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(recents))
+	assert.Equal(t, "pending", recents[0].Status)
+
+	// first attempt fails for both, and they are put off for a while
+	assert.NilError(t, drainQueue(queue))
+	job, err = db.Job(ctx, job.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, "queued", job.State)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, "temporarily broken", job.LastError)
+	assert.Assert(t, job.NextAttempt.After(job.Updated))
+	ran, err := queue.runOne(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, !ran)
+
+	// second attempt fails, third succeeds for one and gives up on the other
+	expireDelays(t, db)
+	assert.NilError(t, drainQueue(queue))
+	expireDelays(t, db)
+	assert.NilError(t, drainQueue(queue))
+
+	job, err = db.Job(ctx, job.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, "done", job.State)
+	assert.Equal(t, 3, job.Attempts)
+	bookmark, ok := db.Get(ctx, "http://example.com")
+	assert.Assert(t, ok)
+	assert.Equal(t, "title for http://example.com</title></head></html>", bookmark.Title)
+	assert.Equal(t, "some notes", bookmark.Notes)
+
+	job2, err = db.Job(ctx, job2.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, "failed", job2.State)
+	results, err := db.Search(ctx, "title")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "ok", results[0].Status)
+	recents, err = db.Recents(ctx, 5)
+	assert.NilError(t, err)
+	for _, recent := range recents {
+		if recent.Url == "http://example2.com" {
+			assert.Equal(t, "failed", recent.Status)
+		}
+	}
+
+	_, err = db.Job(ctx, 1000)
+	assert.Assert(t, errors.Is(err, ErrNotFound))
+}
+
+func TestJobPolicyFailure(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	fetcher := &flakyFetcher{
+		failures: map[string]int{"http://example.com": 1},
+		err:      &PolicyError{"http://example.com", "not allowed"},
+	}
+	queue := NewJobQueue(db, fetcher, JobQueueConfig{})
+
+	job, err := queue.Add(ctx, "http://example.com", "", false)
+	assert.NilError(t, err)
+	assert.NilError(t, drainQueue(queue))
+
+	// forbidden fetches aren't retried
+	job, err = db.Job(ctx, job.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, "failed", job.State)
+	assert.Equal(t, 1, job.Attempts)
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	queue := NewJobQueue(nil, nil, JobQueueConfig{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second})
+	assert.Equal(t, time.Second, queue.retryDelay(1))
+	assert.Equal(t, 2*time.Second, queue.retryDelay(2))
+	assert.Equal(t, 8*time.Second, queue.retryDelay(4))
+	assert.Equal(t, 10*time.Second, queue.retryDelay(5))
+	assert.Equal(t, 10*time.Second, queue.retryDelay(50))
+}
+
+func TestJobQueueRestart(t *testing.T) {
+	dbfile := filepath.Join(t.TempDir(), "bookmark.db")
+	db, err := NewDb(dbfile, NewUrlNormalizer(nil))
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	// a job is interrupted mid-fetch
+	queue := NewJobQueue(db, testFetcher, JobQueueConfig{})
+	_, err = queue.Add(ctx, "http://example.com", "", false)
+	assert.NilError(t, err)
+	_, ok, err := db.ClaimJob(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	db.Close()
+
+	// on restart the workers pick it up again
+	db, err = NewDb(dbfile, NewUrlNormalizer(nil))
+	assert.NilError(t, err)
+	defer db.Close()
+	queue = NewJobQueue(db, testFetcher, JobQueueConfig{PollInterval: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	assert.NilError(t, queue.Start(ctx))
+	_, err = queue.Add(ctx, "http://example2.com", "", false)
+	assert.NilError(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		recents, err := db.Recents(ctx, 5)
+		assert.NilError(t, err)
+		done := 0
+		for _, recent := range recents {
+			if recent.Status == "ok" {
+				done++
+			}
+		}
+		if done == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("jobs were not completed after restart")
+}
+
+// Fetches pages that all say they belong at one canonical url, or that
+// redirect elsewhere without saying
+type canonicalFetcher struct {
+	mockFetcher
+}
+
+func (f *canonicalFetcher) FetchBookmark(ctx context.Context, url string) (BookmarkData, error) {
+	bookmark, err := f.mockFetcher.FetchBookmark(ctx, url)
+	switch {
+	case strings.HasPrefix(url, "https://redirect.com"):
+		bookmark.FinalUrl = "https://final.com/page"
+	case strings.HasPrefix(url, "https://copycat.com"):
+		// claiming to be a page on another site
+		bookmark.FinalUrl = url
+		bookmark.CanonicalUrl = "https://example.com/article/"
+	default:
+		bookmark.FinalUrl = "https://www.example.com/article?ref=share"
+		bookmark.CanonicalUrl = "https://example.com/article/"
+	}
+	return bookmark, err
+}
+
+func TestCanonicalUrls(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	fetcher := &canonicalFetcher{}
+	add := func(rawUrl string, canonical bool, expStatus int) {
+		v := url.Values{"url": {rawUrl}}
+		if canonical {
+			v.Set("canonical", "true")
+		}
+		addFetcherTest(t, db, fetcher, v, expStatus)
+	}
+
+	// the bookmark moves to where the page says it lives
+	add("https://t.co/abc", true, http.StatusAccepted)
+	_, err := db.Bookmark(ctx, "https://example.com/article")
+	assert.NilError(t, err)
+	bookmark, err := db.Bookmark(ctx, "https://t.co/abc")
+	assert.NilError(t, err)
+	assert.Equal(t, "https://example.com/article", bookmark.Url)
+	// either url finds it, so adding them again changes nothing
+	add("https://t.co/abc", true, http.StatusOK)
+	add("https://example.com/article", false, http.StatusOK)
+	assert.NilError(t, db.Hit(ctx, "https://t.co/abc", Visitor{}))
+
+	// another link to the same page joins the bookmark that is already there
+	add("https://bit.ly/xyz", true, http.StatusAccepted)
+	assert.NilError(t, db.Hit(ctx, "https://bit.ly/xyz", Visitor{}))
+	bookmark, err = db.Bookmark(ctx, "https://example.com/article")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, bookmark.HitCount)
+	page, err := db.Page(ctx, PageRequest{Sort: SortAdded, Count: 0})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, page.Total)
+
+	// without a canonical url, the one redirected to will do
+	add("https://redirect.com/", true, http.StatusAccepted)
+	_, ok := db.Get(ctx, "https://final.com/page")
+	assert.Assert(t, ok)
+
+	// a page can't take over the bookmark for a page on another site
+	add("https://copycat.com/article", true, http.StatusAccepted)
+	bookmark, err = db.Bookmark(ctx, "https://copycat.com/article")
+	assert.NilError(t, err)
+	assert.Equal(t, "https://copycat.com/article", bookmark.Url)
+	bookmark, err = db.Bookmark(ctx, "https://example.com/article")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, bookmark.HitCount)
+
+	// and without being asked, the bookmark stays where it was added
+	add("https://t.co/other", false, http.StatusAccepted)
+	_, err = db.Bookmark(ctx, "https://t.co/other")
+	assert.NilError(t, err)
+
+	// aliases are the user's own
+	_, ok = db.Get(withUser(ctx, "bob"), "https://t.co/abc")
+	assert.Assert(t, !ok)
+}
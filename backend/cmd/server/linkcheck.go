@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conditions on a row c of link_checks: the url no longer works, or it
+// redirects somewhere else for good
+const (
+	brokenLink = "(c.status = 0 OR c.status >= 400)"
+	movedLink  = "c.permanent = 1"
+)
+
+// A bookmark whose url is due to be checked
+type LinkToCheck struct {
+	Id  int64
+	Url string
+}
+
+// A bookmark whose url had stopped working as it is when last checked
+type CheckedLink struct {
+	Url     string    `json:"url"`
+	Title   string    `json:"title"`
+	Checked time.Time `json:"checked"`
+	// 0 if there was no response, with the reason in Error
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Where the url redirected to, if it did
+	RedirectUrl string `json:"redirectUrl,omitempty"`
+	// Whether the url is broken, or moved for good, or both
+	Broken    bool `json:"broken"`
+	Permanent bool `json:"permanent"`
+}
+
+// Settings for the link checker. Zero values are replaced by defaults.
+type LinkCheckerConfig struct {
+	// How long a url goes between checks
+	Interval time.Duration
+	// Number of checks run at once
+	Workers int
+	// Number of checks run at once against any one host
+	PerHost int
+	// Number of urls checked in each go
+	BatchSize int
+	// How often to look for urls that are due a check
+	PollInterval time.Duration
+}
+
+var defaultLinkCheckerConfig = LinkCheckerConfig{
+	Interval:     7 * 24 * time.Hour,
+	Workers:      4,
+	PerHost:      1,
+	BatchSize:    100,
+	PollInterval: time.Hour,
+}
+
+// Requests each bookmarked url every so often in the background, to find the
+// ones that have stopped working
+type LinkChecker struct {
+	db      Db
+	fetcher Fetcher
+	config  LinkCheckerConfig
+}
+
+func NewLinkChecker(db Db, fetcher Fetcher, config LinkCheckerConfig) *LinkChecker {
+	if config.Interval <= 0 {
+		config.Interval = defaultLinkCheckerConfig.Interval
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultLinkCheckerConfig.Workers
+	}
+	if config.PerHost <= 0 {
+		config.PerHost = defaultLinkCheckerConfig.PerHost
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultLinkCheckerConfig.BatchSize
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultLinkCheckerConfig.PollInterval
+	}
+	return &LinkChecker{db, fetcher, config}
+}
+
+// Starts checking, until the context is done
+func (checker *LinkChecker) Start(ctx context.Context) {
+	go checker.run(ctx)
+}
+
+func (checker *LinkChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(checker.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		// keep going while there are whole batches due
+		for ctx.Err() == nil {
+			checked, err := checker.checkDue(ctx)
+			if err != nil {
+				log.Printf("Error checking links: %v", err)
+			}
+			if err != nil || checked < checker.config.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks a batch of the urls that are due, returning how many there were
+func (checker *LinkChecker) checkDue(ctx context.Context) (int, error) {
+	links, err := checker.db.LinksToCheck(ctx, time.Now().Add(-checker.config.Interval), checker.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	workers := make(chan struct{}, checker.config.Workers)
+	hosts := make(map[string]chan struct{})
+	var wg sync.WaitGroup
+	for _, link := range links {
+		host := linkHost(link.Url)
+		if hosts[host] == nil {
+			hosts[host] = make(chan struct{}, checker.config.PerHost)
+		}
+		wg.Add(1)
+		go func(hostSlots chan struct{}) {
+			defer wg.Done()
+			// wait for the host before taking up a worker, so that
+			// checks of a busy host don't hold up the others
+			hostSlots <- struct{}{}
+			defer func() { <-hostSlots }()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			checker.checkOne(ctx, link)
+		}(hosts[host])
+	}
+	wg.Wait()
+	return len(links), nil
+}
+
+func (checker *LinkChecker) checkOne(ctx context.Context, link LinkToCheck) {
+	check, checkErr := checker.fetcher.Check(ctx, link.Url)
+	if ctx.Err() != nil {
+		// being stopped says nothing about the link
+		return
+	}
+	err := checker.db.RecordCheck(ctx, link, check, checkErr)
+	if err != nil {
+		log.Printf("Error recording check of %s: %v", link.Url, err)
+	}
+}
+
+// Returns the host a url is on, for sharing out checks; urls that don't
+// parse share the empty host
+func linkHost(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func fetchCheckedLinks(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		links, err := db.CheckedLinks(r.Context())
+		if err != nil {
+			logError(w, fmt.Sprintf("Error fetching checked links: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(links)
+	}
+}
+
+// The outcome of following redirects
+type followSummary struct {
+	Updated int `json:"updated"`
+}
+
+// Moves bookmarks that redirect for good to where they redirect to: those
+// named by url parameters, or all of them if there are none
+func followRedirects(db Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updated, err := db.FollowRedirects(r.Context(), r.URL.Query()["url"])
+		if err != nil {
+			logError(w, fmt.Sprintf("Error following redirects: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(followSummary{updated})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// Answers checks from a table, keeping track of how many checks of each host
+// run at once. Urls missing from the table get no response.
+type checkFetcher struct {
+	mockFetcher
+	checks      map[string]LinkCheck
+	mu          sync.Mutex
+	running     map[string]int
+	mostRunning map[string]int
+}
+
+func (f *checkFetcher) Check(_ context.Context, url string) (LinkCheck, error) {
+	host := linkHost(url)
+	f.mu.Lock()
+	f.running[host]++
+	f.mostRunning[host] = max(f.mostRunning[host], f.running[host])
+	f.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	f.mu.Lock()
+	f.running[host]--
+	f.mu.Unlock()
+
+	check, ok := f.checks[url]
+	if !ok {
+		return LinkCheck{}, errors.New("no such host")
+	}
+	return check, nil
+}
+
+func TestLinkChecker(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	bob := withUser(ctx, "bob")
+	for _, url := range []string{"http://a.com/1", "http://a.com/2", "http://a.com/3", "http://b.com",
+		"http://c.com", "http://d.com/old", "http://d.com/new", "http://e.com"} {
+		assert.NilError(t, db.Insert(ctx, url, BookmarkData{Title: url}))
+	}
+	assert.NilError(t, db.Insert(bob, "http://a.com/3", BookmarkData{Title: "bob's"}))
+
+	fetcher := &checkFetcher{
+		checks: map[string]LinkCheck{
+			"http://a.com/1":   {Status: http.StatusOK},
+			"http://a.com/2":   {Status: http.StatusNotFound},
+			"http://a.com/3":   {http.StatusOK, "http://a.com/new", true},
+			"http://b.com":     {http.StatusOK, "http://b.com/login", false},
+			"http://d.com/old": {http.StatusOK, "http://d.com/new", true},
+			"http://d.com/new": {Status: http.StatusOK},
+			"http://e.com":     {http.StatusGone, "http://e.com/gone", true},
+		},
+		running:     map[string]int{},
+		mostRunning: map[string]int{},
+	}
+	checker := NewLinkChecker(db, fetcher, LinkCheckerConfig{Workers: 4, PerHost: 1, BatchSize: 3})
+	for {
+		checked, err := checker.checkDue(ctx)
+		assert.NilError(t, err)
+		if checked < 3 {
+			break
+		}
+	}
+	assert.Equal(t, 1, fetcher.mostRunning["a.com"])
+
+	// nothing is due until the interval has passed
+	links, err := db.LinksToCheck(ctx, time.Now().Add(-time.Hour), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(links))
+	links, err = db.LinksToCheck(ctx, time.Now().Add(time.Minute), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 9, len(links))
+
+	assert.DeepEqual(t, []string{"http://a.com/2", "http://c.com", "http://e.com"},
+		allPages(t, db, PageRequest{Query: "is:broken", Sort: SortAlphabetical, Count: 10}, nil))
+	assert.DeepEqual(t, []string{"http://a.com/3", "http://d.com/old", "http://e.com"},
+		allPages(t, db, PageRequest{Query: "is:moved", Sort: SortAlphabetical, Count: 10}, nil))
+
+	checked, err := db.CheckedLinks(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 5, len(checked))
+	assert.Equal(t, "http://c.com", checked[2].Url)
+	assert.Equal(t, 0, checked[2].Status)
+	assert.Equal(t, "no such host", checked[2].Error)
+	assert.Assert(t, checked[2].Broken && !checked[2].Permanent)
+	assert.Equal(t, "http://e.com/gone", checked[4].RedirectUrl)
+	assert.Assert(t, checked[4].Broken && checked[4].Permanent)
+	assert.Assert(t, !checked[4].Checked.IsZero())
+
+	// d.com/new is already bookmarked and e.com/gone is broken, so only
+	// a.com/3 moves, and only for the one user
+	updated, err := db.FollowRedirects(ctx, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, updated)
+	bookmark, err := db.Bookmark(ctx, "http://a.com/new")
+	assert.NilError(t, err)
+	// and the old url still finds it
+	moved, err := db.Bookmark(ctx, "http://a.com/3")
+	assert.NilError(t, err)
+	assert.Equal(t, bookmark.Url, moved.Url)
+	_, ok := db.Get(ctx, "http://a.com/new")
+	assert.Assert(t, ok)
+	_, ok = db.Get(bob, "http://a.com/3")
+	assert.Assert(t, ok)
+	// the new url is due a check of its own
+	links, err = db.LinksToCheck(ctx, time.Now().Add(-time.Hour), 10)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []LinkToCheck{{links[0].Id, "http://a.com/new"}}, links)
+
+	// a check that raced with the move isn't recorded against the new url
+	assert.NilError(t, db.RecordCheck(ctx, LinkToCheck{links[0].Id, "http://a.com/3"}, LinkCheck{Status: http.StatusOK}, nil))
+	links, err = db.LinksToCheck(ctx, time.Now().Add(-time.Hour), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(links))
+
+	checked, err = db.CheckedLinks(bob)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(checked))
+	assert.Equal(t, "http://a.com/3", checked[0].Url)
+}
+
+func TestLinkHandlers(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	for _, url := range []string{"http://a.com", "http://b.com"} {
+		assert.NilError(t, db.Insert(ctx, url, BookmarkData{Title: url}))
+	}
+	checker := NewLinkChecker(db, &checkFetcher{
+		checks: map[string]LinkCheck{
+			"http://a.com": {http.StatusOK, "https://a.com/", true},
+			"http://b.com": {http.StatusOK, "https://b.com/", true},
+		},
+		running:     map[string]int{},
+		mostRunning: map[string]int{},
+	}, LinkCheckerConfig{})
+	_, err := checker.checkDue(ctx)
+	assert.NilError(t, err)
+
+	var links []CheckedLink
+	req := httptest.NewRequest(http.MethodGet, "/api/links", nil)
+	w := httptest.NewRecorder()
+	fetchCheckedLinks(db)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&links))
+	assert.Equal(t, 2, len(links))
+	assert.Equal(t, "https://a.com/", links[0].RedirectUrl)
+
+	var summary followSummary
+	req = httptest.NewRequest(http.MethodPost, "/api/links/follow?url="+url.QueryEscape("http://b.com/"), nil)
+	w = httptest.NewRecorder()
+	followRedirects(db)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&summary))
+	assert.Equal(t, 1, summary.Updated)
+	// in the normal form of where it redirected to
+	bookmark, err := db.Bookmark(ctx, "https://b.com/")
+	assert.NilError(t, err)
+	assert.Equal(t, "https://b.com", bookmark.Url)
+	_, ok := db.Get(ctx, "http://a.com")
+	assert.Assert(t, ok)
+}
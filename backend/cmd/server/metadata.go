@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Everything of interest found while walking a page
+type pageMetadata struct {
+	title     string
+	meta      map[string]string
+	canonical string
+	jsonLd    []any
+	head      *html.Node
+}
+
+// Walks the parsed page collecting the title, meta tags, canonical link and
+// JSON-LD blocks. Only the first occurrence of each meta tag is kept.
+func collectMetadata(doc *html.Node) *pageMetadata {
+	page := &pageMetadata{meta: make(map[string]string)}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Head:
+				if page.head == nil {
+					page.head = n
+				}
+			case atom.Title:
+				// an svg can have a title of its own, so stick to the head
+				if page.title == "" && n.FirstChild != nil && n.Parent.DataAtom == atom.Head {
+					page.title = n.FirstChild.Data
+				}
+			case atom.Meta:
+				key := getAttr(n, "property")
+				if key == "" {
+					key = getAttr(n, "name")
+				}
+				key = strings.ToLower(key)
+				if _, ok := page.meta[key]; key != "" && !ok {
+					page.meta[key] = getAttr(n, "content")
+				}
+			case atom.Link:
+				for _, rel := range strings.Fields(strings.ToLower(getAttr(n, "rel"))) {
+					if rel == "canonical" && page.canonical == "" {
+						page.canonical = getAttr(n, "href")
+					}
+				}
+			case atom.Script:
+				if strings.EqualFold(getAttr(n, "type"), "application/ld+json") && n.FirstChild != nil {
+					var data any
+					if json.Unmarshal([]byte(n.FirstChild.Data), &data) == nil {
+						page.jsonLd = append(page.jsonLd, data)
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return page
+}
+
+// Returns the first non-empty candidate with whitespace tidied up
+func firstOf(candidates ...string) string {
+	for _, candidate := range candidates {
+		candidate = strings.Join(strings.Fields(candidate), " ")
+		if candidate != "" {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Resolves a possibly-relative url against the page url, returning "" for
+// anything unusable
+func resolveUrl(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+		return ""
+	}
+	return resolved.String()
+}
+
+// Searches JSON-LD data, including arrays and @graph collections, for the
+// first usable value of a property. Values may be plain strings or objects
+// carrying a name or url, such as an author Person or an ImageObject.
+func jsonLdValue(data any, property string) string {
+	switch v := data.(type) {
+	case []any:
+		for _, item := range v {
+			if value := jsonLdValue(item, property); value != "" {
+				return value
+			}
+		}
+	case map[string]any:
+		if value := jsonLdString(v[property]); value != "" {
+			return value
+		}
+		return jsonLdValue(v["@graph"], property)
+	}
+	return ""
+}
+
+func jsonLdString(data any) string {
+	switch v := data.(type) {
+	case string:
+		return v
+	case []any:
+		for _, item := range v {
+			if value := jsonLdString(item); value != "" {
+				return value
+			}
+		}
+	case map[string]any:
+		if name, ok := v["name"].(string); ok {
+			return name
+		}
+		if url, ok := v["url"].(string); ok {
+			return url
+		}
+	}
+	return ""
+}
+
+// Fills in the bookmark from the page's metadata. Sites vary wildly in what
+// they provide, so each field is taken from the first source that has it.
+//
+// The title is chosen in this order, since the social-media titles are
+// usually the cleanest and <title> is often cluttered with the site name or
+// missing from pages that are rendered by script:
+//  1. og:title
+//  2. twitter:title
+//  3. JSON-LD headline
+//  4. <title>
+//  5. JSON-LD name
+func extractMetadata(page *pageMetadata, base *url.URL, bookmark *BookmarkData) {
+	ld := func(property string) string {
+		return jsonLdValue(page.jsonLd, property)
+	}
+	bookmark.Title = firstOf(page.meta["og:title"], page.meta["twitter:title"], ld("headline"), page.title, ld("name"))
+	bookmark.Description = firstOf(page.meta["og:description"], page.meta["twitter:description"], page.meta["description"], ld("description"))
+	bookmark.SiteName = firstOf(page.meta["og:site_name"], page.meta["application-name"], ld("publisher"))
+	bookmark.Author = firstOf(page.meta["author"], page.meta["article:author"], ld("author"), page.meta["twitter:creator"])
+	bookmark.CanonicalUrl = firstOf(resolveUrl(base, page.canonical), resolveUrl(base, page.meta["og:url"]))
+	bookmark.ImageUrl = firstOf(
+		resolveUrl(base, page.meta["og:image"]),
+		resolveUrl(base, page.meta["twitter:image"]),
+		resolveUrl(base, page.meta["twitter:image:src"]),
+		resolveUrl(base, ld("image")))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"gotest.tools/assert"
+)
+
+func extractTest(t *testing.T, page string) BookmarkData {
+	doc, err := html.Parse(strings.NewReader(page))
+	assert.NilError(t, err)
+	base, err := url.Parse("https://example.com/articles/1?ref=home")
+	assert.NilError(t, err)
+	var bookmark BookmarkData
+	extractMetadata(collectMetadata(doc), base, &bookmark)
+	return bookmark
+}
+
+func TestExtractMetadataOpenGraph(t *testing.T) {
+	bookmark := extractTest(t, `<html><head>
+		<title>An Article | Example Site</title>
+		<meta name="description" content="plain description">
+		<meta property="og:title" content="  An
+			Article ">
+		<meta property="og:description" content="og description">
+		<meta property="og:site_name" content="Example Site">
+		<meta property="og:image" content="/images/lead.jpg">
+		<meta name="twitter:title" content="twitter title">
+		<meta name="author" content="Jane Writer">
+		<link rel="canonical" href="/articles/1">
+		</head><body></body></html>`)
+	assert.DeepEqual(t, BookmarkData{
+		Title:        "An Article",
+		Description:  "og description",
+		SiteName:     "Example Site",
+		ImageUrl:     "https://example.com/images/lead.jpg",
+		Author:       "Jane Writer",
+		CanonicalUrl: "https://example.com/articles/1",
+	}, bookmark)
+}
+
+func TestExtractMetadataTwitter(t *testing.T) {
+	bookmark := extractTest(t, `<html><head>
+		<title>An Article | Example Site</title>
+		<meta name="twitter:title" content="twitter title">
+		<meta name="twitter:description" content="twitter description">
+		<meta name="twitter:image" content="https://cdn.example.com/lead.jpg">
+		<meta name="twitter:creator" content="@writer">
+		<meta property="og:url" content="https://example.com/articles/1">
+		</head><body></body></html>`)
+	assert.DeepEqual(t, BookmarkData{
+		Title:        "twitter title",
+		Description:  "twitter description",
+		ImageUrl:     "https://cdn.example.com/lead.jpg",
+		Author:       "@writer",
+		CanonicalUrl: "https://example.com/articles/1",
+	}, bookmark)
+}
+
+func TestExtractMetadataJsonLd(t *testing.T) {
+	bookmark := extractTest(t, `<html><head>
+		<script type="application/ld+json">not json</script>
+		<script type="application/ld+json">{
+			"@context": "https://schema.org",
+			"@graph": [
+				{"@type": "WebSite", "url": "https://example.com/"},
+				{
+					"@type": "NewsArticle",
+					"headline": "Headline from JSON-LD",
+					"description": "ld description",
+					"image": [{"@type": "ImageObject", "url": "https://example.com/ld.jpg"}],
+					"author": [{"@type": "Person", "name": "Jane Writer"}],
+					"publisher": {"@type": "Organization", "name": "Example News"}
+				}
+			]
+		}</script>
+		</head><body><svg><title>not the title</title></svg></body></html>`)
+	assert.DeepEqual(t, BookmarkData{
+		Title:       "Headline from JSON-LD",
+		Description: "ld description",
+		SiteName:    "Example News",
+		ImageUrl:    "https://example.com/ld.jpg",
+		Author:      "Jane Writer",
+	}, bookmark)
+}
+
+func TestExtractMetadataTitleOnly(t *testing.T) {
+	bookmark := extractTest(t, `<html><head><title>Just a title</title>
+		<link rel="canonical" href="javascript:alert(1)">
+		</head></html>`)
+	assert.DeepEqual(t, BookmarkData{Title: "Just a title"}, bookmark)
+
+	// a page with nothing to offer
+	bookmark = extractTest(t, `<p>hello</p>`)
+	assert.DeepEqual(t, BookmarkData{}, bookmark)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A bookmark brought in from elsewhere, carrying history that the fetcher
+// can't supply
+type ImportedBookmark struct {
+	Url string
+	BookmarkData
+	Tags       []string
+	Added      time.Time
+	LastAccess time.Time
+}
+
+// A bookmark as it is stored, for export
+type ExportedBookmark struct {
+	ImportedBookmark
+	IsFavorite bool
+	HitCount   int
+	Status     string
+	// Oldest first
+	Visits []ExportedVisit
+	// Other urls that lead to the bookmark
+	Aliases []string
+}
+
+// A visit to a bookmark as it is stored, for export
+type ExportedVisit struct {
+	Visited   time.Time
+	Client    string
+	UserAgent string
+}
+
+// The outcome of an import
+type importSummary struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors"`
+}
+
+// Only the first few errors are worth reporting
+const maxImportErrors = 20
+
+func (summary *importSummary) fail(url string, err error) {
+	summary.Failed++
+	if len(summary.Errors) < maxImportErrors {
+		summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", url, err))
+	}
+}
+
+func (summary importSummary) String() string {
+	return fmt.Sprintf("imported %d, skipped %d, failed %d", summary.Imported, summary.Skipped, summary.Failed)
+}
+
+// Parses a timestamp attribute. These are meant to be seconds since the
+// epoch, but some browsers have been known to write milli- or microseconds.
+func parseNetscapeTime(value string) time.Time {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}
+	}
+	switch {
+	case n > 1e14:
+		return time.UnixMicro(n)
+	case n > 1e11:
+		return time.UnixMilli(n)
+	}
+	return time.Unix(n, 0)
+}
+
+// Decodes a base64 data url, as used for the ICON attribute
+func parseDataUrl(value string) (data []byte, contentType string) {
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(value, "data:"), ",")
+	if !ok || !strings.HasPrefix(value, "data:") || !strings.HasSuffix(header, ";base64") {
+		return nil, ""
+	}
+	contentType = strings.TrimSuffix(header, ";base64")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, ""
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ""
+	}
+	return data, contentType
+}
+
+// Turns a folder name into a tag
+func folderTag(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), "-"))
+}
+
+// Parses a Netscape bookmark file, as exported by every browser, calling fn
+// for each bookmark found. The names of the folders enclosing a bookmark
+// become its tags, except for the browser's own toolbar and "other
+// bookmarks" folders, along with anything in a TAGS attribute. A <DD>
+// following a bookmark becomes its notes. Without a LAST_VISIT, the
+// ADD_DATE stands in for when the bookmark was last accessed.
+func parseNetscape(r io.Reader, fn func(ImportedBookmark)) error {
+	tokenizer := html.NewTokenizer(r)
+	// the tag for each open <DL>, "" for those that don't get one
+	var folders []string
+	// the name of the folder whose <DL> is expected next
+	pendingFolder := ""
+	var current *ImportedBookmark
+	// what the text being read belongs to
+	var text *string
+	var folderName string
+	var notes string
+
+	flush := func() {
+		if current != nil {
+			current.Notes = strings.TrimSpace(notes)
+			fn(*current)
+			current = nil
+		}
+		notes = ""
+	}
+
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			flush()
+			if errors.Is(tokenizer.Err(), io.EOF) {
+				return nil
+			}
+			return tokenizer.Err()
+
+		case html.TextToken:
+			if text != nil {
+				*text += string(tokenizer.Text())
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = tokenizer.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+			switch atom.Lookup(name) {
+			case atom.Dt, atom.Dl:
+				flush()
+				text = nil
+				if atom.Lookup(name) == atom.Dl {
+					folders = append(folders, pendingFolder)
+					pendingFolder = ""
+				}
+			case atom.H3:
+				flush()
+				folderName = ""
+				text = &folderName
+				_, toolbar := attrs["personal_toolbar_folder"]
+				_, unfiled := attrs["unfiled_bookmarks_folder"]
+				if toolbar || unfiled {
+					// no tag for this one
+					text = nil
+				}
+			case atom.A:
+				flush()
+				current = &ImportedBookmark{
+					Url:        strings.TrimSpace(attrs["href"]),
+					Added:      parseNetscapeTime(attrs["add_date"]),
+					LastAccess: parseNetscapeTime(attrs["last_visit"]),
+				}
+				if current.LastAccess.IsZero() {
+					current.LastAccess = current.Added
+				}
+				current.Icon, current.IconType = parseDataUrl(attrs["icon"])
+				for _, folder := range folders {
+					if folder != "" {
+						current.Tags = append(current.Tags, folder)
+					}
+				}
+				for _, tag := range strings.Split(attrs["tags"], ",") {
+					if tag = folderTag(tag); tag != "" {
+						current.Tags = append(current.Tags, tag)
+					}
+				}
+				text = &current.Title
+			case atom.Dd:
+				text = &notes
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.H3:
+				if text == &folderName {
+					pendingFolder = folderTag(folderName)
+				}
+				text = nil
+			case atom.A:
+				if current != nil {
+					current.Title = strings.TrimSpace(current.Title)
+				}
+				text = nil
+			case atom.Dl:
+				flush()
+				text = nil
+				if len(folders) > 0 {
+					folders = folders[:len(folders)-1]
+				}
+			}
+		}
+	}
+}
+
+// Imports a Netscape bookmark file, leaving alone any bookmarks that
+// already exist
+func importNetscape(ctx context.Context, db Db, r io.Reader) (importSummary, error) {
+	summary := importSummary{Errors: []string{}}
+	err := parseNetscape(r, func(bookmark ImportedBookmark) {
+		u, err := url.Parse(bookmark.Url)
+		if err != nil {
+			summary.fail(bookmark.Url, err)
+			return
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			summary.fail(bookmark.Url, fmt.Errorf("scheme %q is not http or https", u.Scheme))
+			return
+		}
+		bookmark.Url = db.NormalizeUrl(bookmark.Url)
+		if bookmark.Added.IsZero() {
+			bookmark.Added = time.Now()
+		}
+		if bookmark.LastAccess.IsZero() {
+			bookmark.LastAccess = bookmark.Added
+		}
+		err = db.Import(ctx, bookmark)
+		if errors.Is(err, ErrExists) {
+			summary.Skipped++
+			return
+		}
+		if err != nil {
+			summary.fail(bookmark.Url, err)
+			return
+		}
+		summary.Imported++
+	})
+	return summary, err
+}
+
+const netscapeHeader = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`
+
+// Formats a time as seconds since the epoch, leaving out unknown times
+func netscapeTime(name string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(` %s="%d"`, name, t.Unix())
+}
+
+// Writes one bookmark as a <DT> entry, with its notes in a <DD>
+func writeNetscapeBookmark(w io.Writer, bookmark ExportedBookmark, indent string) error {
+	title := bookmark.Title
+	if title == "" {
+		title = bookmark.Url
+	}
+	tags := ""
+	if len(bookmark.Tags) > 0 {
+		tags = fmt.Sprintf(` TAGS="%s"`, html.EscapeString(strings.Join(bookmark.Tags, ",")))
+	}
+	_, err := fmt.Fprintf(w, "%s<DT><A HREF=\"%s\"%s%s%s>%s</A>\n", indent,
+		html.EscapeString(bookmark.Url),
+		netscapeTime("ADD_DATE", bookmark.Added),
+		netscapeTime("LAST_VISIT", bookmark.LastAccess),
+		tags, html.EscapeString(title))
+	if err != nil {
+		return err
+	}
+	if bookmark.Notes != "" {
+		_, err = fmt.Fprintf(w, "%s<DD>%s\n", indent, html.EscapeString(bookmark.Notes))
+	}
+	return err
+}
+
+// Writes every bookmark as a Netscape bookmark file that any browser can
+// import. Favorites go in the toolbar folder, which is the closest thing
+// browsers have to them, and tags go in a TAGS attribute as Firefox and
+// Pinboard write them. Bookmarks are written as they are read from the
+// database.
+func exportNetscape(ctx context.Context, db Db, w io.Writer) error {
+	_, err := io.WriteString(w, netscapeHeader)
+	if err != nil {
+		return err
+	}
+	inFavorites := false
+	err = db.Export(ctx, func(bookmark ExportedBookmark) error {
+		var err error
+		if bookmark.IsFavorite && !inFavorites {
+			inFavorites = true
+			_, err = io.WriteString(w, "    <DT><H3 PERSONAL_TOOLBAR_FOLDER=\"true\">Favorites</H3>\n    <DL><p>\n")
+		} else if !bookmark.IsFavorite && inFavorites {
+			inFavorites = false
+			_, err = io.WriteString(w, "    </DL><p>\n")
+		}
+		if err != nil {
+			return err
+		}
+		if inFavorites {
+			return writeNetscapeBookmark(w, bookmark, "        ")
+		}
+		return writeNetscapeBookmark(w, bookmark, "    ")
+	})
+	if err != nil {
+		return err
+	}
+	if inFavorites {
+		_, err = io.WriteString(w, "    </DL><p>\n")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "</DL><p>\n")
+	return err
+}
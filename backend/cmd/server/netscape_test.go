@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const netscapeFile = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1700000000" LAST_MODIFIED="1700000000" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DL><p>
+        <DT><A HREF="https://go.dev/" ADD_DATE="1600000000" ICON="data:image/png;base64,aWNvbg==">The Go Programming Language</A>
+        <DT><H3 ADD_DATE="1700000000">Cooking  Stuff</H3>
+        <DD>folder description
+        <DL><p>
+            <DT><A HREF="https://www.seriouseats.com/" ADD_DATE="1650000000000" LAST_VISIT="1660000000" TAGS="food,Recipes">Serious Eats &amp; more</A>
+            <DD>Good for weeknights
+            <DT><H3>Baking</H3>
+            <DL><p>
+                <DT><A HREF="https://example.com/bread">Bread</A>
+            </DL><p>
+        </DL><p>
+        <DT><A HREF="javascript:alert(1)">Bookmarklet</A>
+        <DT><A HREF="place:sort=8&maxResults=10">Recent</A>
+    </DL><p>
+    <DT><A HREF="https://example.com/other" ADD_DATE="1500000000">Other</A>
+</DL><p>
+`
+
+func TestParseNetscape(t *testing.T) {
+	var bookmarks []ImportedBookmark
+	err := parseNetscape(strings.NewReader(netscapeFile), func(bookmark ImportedBookmark) {
+		bookmarks = append(bookmarks, bookmark)
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 6, len(bookmarks))
+
+	assert.Equal(t, "https://go.dev/", bookmarks[0].Url)
+	assert.Equal(t, "The Go Programming Language", bookmarks[0].Title)
+	assert.Equal(t, 0, len(bookmarks[0].Tags))
+	assert.Equal(t, time.Unix(1600000000, 0), bookmarks[0].LastAccess)
+	assert.DeepEqual(t, []byte("icon"), bookmarks[0].Icon)
+	assert.Equal(t, "image/png", bookmarks[0].IconType)
+
+	assert.Equal(t, "Serious Eats & more", bookmarks[1].Title)
+	assert.DeepEqual(t, []string{"cooking-stuff", "food", "recipes"}, bookmarks[1].Tags)
+	assert.Equal(t, "Good for weeknights", bookmarks[1].Notes)
+	// milliseconds
+	assert.Equal(t, time.Unix(1650000000, 0), bookmarks[1].Added)
+	assert.Equal(t, time.Unix(1660000000, 0), bookmarks[1].LastAccess)
+
+	assert.Equal(t, "https://example.com/bread", bookmarks[2].Url)
+	assert.DeepEqual(t, []string{"cooking-stuff", "baking"}, bookmarks[2].Tags)
+	assert.Assert(t, bookmarks[2].LastAccess.IsZero())
+
+	assert.Equal(t, "javascript:alert(1)", bookmarks[3].Url)
+
+	assert.Equal(t, "https://example.com/other", bookmarks[5].Url)
+	assert.Equal(t, 0, len(bookmarks[5].Tags))
+	assert.Equal(t, "", bookmarks[5].Notes)
+}
+
+func TestImportNetscape(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	// one of them is already there
+	assert.NilError(t, db.Insert(ctx, "https://example.com/other", BookmarkData{Title: "mine"}))
+
+	summary, err := importNetscape(ctx, db, strings.NewReader(netscapeFile))
+	assert.NilError(t, err)
+	assert.Equal(t, 3, summary.Imported)
+	assert.Equal(t, 1, summary.Skipped)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, 2, len(summary.Errors))
+
+	// the existing bookmark is untouched
+	bookmark, ok := db.Get(ctx, "https://example.com/other")
+	assert.Assert(t, ok)
+	assert.Equal(t, "mine", bookmark.Title)
+
+	tags, err := db.Tags(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tagList{{"baking", 1}, {"cooking-stuff", 2}, {"food", 1}, {"recipes", 1}}, tags)
+
+	// add date becomes the access time
+	var lastAccess string
+	assert.NilError(t, db.db.QueryRow("SELECT lastAccess FROM bookmarks WHERE url = 'https://go.dev'").Scan(&lastAccess))
+	assert.Equal(t, "2020-09-13T12:26:40Z", lastAccess)
+
+	icon, err := db.Icon(ctx, "https://go.dev/")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []byte("icon"), icon.Data)
+
+	results, err := db.Search(ctx, "weeknights")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// importing again changes nothing
+	summary, err = importNetscape(ctx, db, strings.NewReader(netscapeFile))
+	assert.NilError(t, err)
+	assert.Equal(t, 0, summary.Imported)
+	assert.Equal(t, 4, summary.Skipped)
+}
+
+func TestExportNetscape(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Import(ctx, ImportedBookmark{
+		Url:          "https://example.com/?a=1&b=2",
+		BookmarkData: BookmarkData{Title: "Fish & <Chips>", Notes: "crispy"},
+		Tags:         []string{"food", "uk"},
+		Added:        time.Unix(1500000000, 0),
+		LastAccess:   time.Unix(1600000000, 0),
+	}))
+	assert.NilError(t, db.Insert(ctx, "https://go.dev/", BookmarkData{Title: "Go"}))
+	assert.NilError(t, db.SetFavorite(ctx, "https://go.dev/", true))
+	_, err := db.AddPending(ctx, "https://example.com/pending", BookmarkData{}, false)
+	assert.NilError(t, err)
+
+	var out strings.Builder
+	assert.NilError(t, exportNetscape(ctx, db, &out))
+	assert.Assert(t, strings.Contains(out.String(), `PERSONAL_TOOLBAR_FOLDER="true"`))
+
+	var bookmarks []ImportedBookmark
+	err = parseNetscape(strings.NewReader(out.String()), func(bookmark ImportedBookmark) {
+		bookmarks = append(bookmarks, bookmark)
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(bookmarks))
+
+	// favorites come first
+	assert.Equal(t, "https://go.dev/", bookmarks[0].Url)
+	assert.Equal(t, "Go", bookmarks[0].Title)
+	assert.Equal(t, 0, len(bookmarks[0].Tags))
+
+	assert.Equal(t, "https://example.com/?a=1&b=2", bookmarks[1].Url)
+	assert.Equal(t, "Fish & <Chips>", bookmarks[1].Title)
+	assert.Equal(t, "crispy", bookmarks[1].Notes)
+	assert.DeepEqual(t, []string{"food", "uk"}, bookmarks[1].Tags)
+	assert.Equal(t, time.Unix(1500000000, 0), bookmarks[1].Added)
+	assert.Equal(t, time.Unix(1600000000, 0), bookmarks[1].LastAccess)
+
+	// a bookmark without a title yet is named after its url
+	assert.Equal(t, "https://example.com/pending", bookmarks[2].Title)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The order to list bookmarks in
+type SortOrder string
+
+const (
+	// Most recently accessed first
+	SortRecent SortOrder = "recent"
+	// Most often accessed first
+	SortFrequent SortOrder = "frequent"
+	// Most used first, with recent visits counting for more than old ones
+	SortFrecency SortOrder = "frecency"
+	// By title
+	SortAlphabetical SortOrder = "alphabetical"
+	// Most recently added first
+	SortAdded SortOrder = "added"
+	// Best search match first. Without any words to search for, this is the
+	// same as SortRecent. Search scores shift as bookmarks are added and
+	// visited, so there is no carrying on where a page left off; ask for a
+	// bigger count instead.
+	SortRelevance SortOrder = "relevance"
+)
+
+// How to order by each sort: the expression to order by, which the bookmark
+// id breaks ties in, and whether it is descending
+var sortKeys = map[SortOrder]struct {
+	key  string
+	desc bool
+}{
+	SortRecent:       {"ifnull(b.lastAccess, '')", true},
+	SortFrequent:     {"ifnull(b.hitCount, 0)", true},
+	SortFrecency:     {"b.frecency", true},
+	SortAlphabetical: {"ifnull(b.title, '') COLLATE NOCASE", false},
+	SortAdded:        {"ifnull(b.added, '')", true},
+	SortRelevance:    {searchRank, false},
+}
+
+// Parses the sort parameter of a listing, which defaults to def
+func parseSort(sort string, def SortOrder) (SortOrder, error) {
+	if sort == "" {
+		return def, nil
+	}
+	if _, ok := sortKeys[SortOrder(sort)]; !ok {
+		return def, fmt.Errorf("unknown sort %q", sort)
+	}
+	return SortOrder(sort), nil
+}
+
+// Asks for a page of bookmarks
+type PageRequest struct {
+	// A search query as understood by parseQuery, or "" for every bookmark
+	Query string
+	// Only favorites
+	Favorites bool
+	// Leave out bookmarks whose page had no title
+	Titled bool
+	Sort   SortOrder
+	// Where the previous page left off, or "" for the first page
+	Cursor string
+	// The most bookmarks to return, or -1 for all of them
+	Count int
+}
+
+// A page of bookmarks
+type Page struct {
+	Items bookmarkList `json:"items"`
+	// Asks for the next page, or "" if this is the last
+	NextCursor string `json:"nextCursor"`
+	// How many bookmarks there are on all the pages together
+	Total int `json:"total"`
+}
+
+// Returned when a cursor can't be used to carry on a listing
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Returned for a cursor in a listing by relevance, which can't be paged
+var ErrUnpagedSort = errors.New("search results in order of relevance come in a single page, so ask for a bigger count rather than using a cursor")
+
+// Where a listing left off: the sort key and id of the last bookmark on a
+// page. Carrying on from there, rather than from a count of bookmarks, means
+// bookmarks added in the meantime don't shift the pages along.
+type pageCursor struct {
+	Sort SortOrder `json:"sort"`
+	Key  any       `json:"key"`
+	Id   int64     `json:"id"`
+}
+
+func (cursor pageCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decodes a cursor, checking that it came from a listing in the same order
+func decodeCursor(s string, sort SortOrder) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.Sort != sort {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Reads every page of a listing, calling between after each one
+func allPages(t *testing.T, db Db, req PageRequest, between func()) []string {
+	var urls []string
+	for {
+		page, err := db.Page(context.Background(), req)
+		assert.NilError(t, err)
+		assert.Assert(t, len(page.Items) <= req.Count)
+		for _, item := range page.Items {
+			urls = append(urls, item.Url)
+		}
+		if page.NextCursor == "" {
+			return urls
+		}
+		req.Cursor = page.NextCursor
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess, added, hitCount) VALUES
+			(1, 'http://a.com', 'Banana bread', '2025-03-05', '2025-01-01', 3),
+			(1, 'http://b.com', 'apple pie', '2025-03-04', '2025-01-02', 3),
+			(1, 'http://c.com', 'Cherry pie', '2025-03-03', '2025-01-03', 7),
+			(1, 'http://d.com', 'date squares', '2025-03-02', '2025-01-04', 1),
+			(1, 'http://e.com', 'pie crust', '2025-03-01', '2025-01-05', 0)`)
+	assert.NilError(t, err)
+
+	for _, test := range []struct {
+		sort SortOrder
+		urls []string
+	}{
+		{SortRecent, []string{"http://a.com", "http://b.com", "http://c.com", "http://d.com", "http://e.com"}},
+		{SortFrequent, []string{"http://c.com", "http://b.com", "http://a.com", "http://d.com", "http://e.com"}},
+		{SortAlphabetical, []string{"http://b.com", "http://a.com", "http://c.com", "http://d.com", "http://e.com"}},
+		{SortAdded, []string{"http://e.com", "http://d.com", "http://c.com", "http://b.com", "http://a.com"}},
+	} {
+		for _, count := range []int{1, 2, 5} {
+			urls := allPages(t, db, PageRequest{Sort: test.sort, Count: count}, nil)
+			assert.DeepEqual(t, test.urls, urls)
+		}
+	}
+
+	// search results are in order of relevance, which is a tie here, or of
+	// access without any words to search for
+	urls := allPages(t, db, PageRequest{Query: "pie", Sort: SortRelevance, Count: 5}, nil)
+	assert.DeepEqual(t, []string{"http://b.com", "http://c.com", "http://e.com"}, urls)
+	urls = allPages(t, db, PageRequest{Query: "-pie", Sort: SortRelevance, Count: 1}, nil)
+	assert.DeepEqual(t, []string{"http://a.com", "http://d.com"}, urls)
+
+	page, err := db.Page(ctx, PageRequest{Query: "pie", Sort: SortAlphabetical, Count: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 2, len(page.Items))
+
+	// just counting
+	page, err = db.Page(ctx, PageRequest{Query: "pie", Sort: SortAlphabetical, Count: 0})
+	assert.NilError(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 0, len(page.Items))
+	assert.Equal(t, "", page.NextCursor)
+
+	// bookmarks added part way through don't disturb the pages
+	added := 0
+	urls = allPages(t, db, PageRequest{Sort: SortRecent, Count: 2}, func() {
+		added++
+		assert.NilError(t, db.Insert(ctx, fmt.Sprintf("http://new%d.com", added), BookmarkData{Title: "new"}))
+	})
+	assert.DeepEqual(t, []string{"http://a.com", "http://b.com", "http://c.com", "http://d.com", "http://e.com"}, urls)
+
+	// scores change as bookmarks are added, so relevance isn't paged at all
+	// rather than skipping or repeating results
+	page, err = db.Page(ctx, PageRequest{Query: "pie", Sort: SortRelevance, Count: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, "", page.NextCursor)
+	assert.NilError(t, db.Insert(ctx, "http://pie.com", BookmarkData{Title: "pie pie pie"}))
+	recent, err := db.Page(ctx, PageRequest{Sort: SortRecent, Count: 1})
+	assert.NilError(t, err)
+	_, err = db.Page(ctx, PageRequest{Query: "pie", Sort: SortRelevance, Count: 2, Cursor: recent.NextCursor})
+	assert.Equal(t, ErrUnpagedSort, err)
+	page, err = db.Page(ctx, PageRequest{Query: "pie", Sort: SortRelevance, Count: 10})
+	assert.NilError(t, err)
+	assert.Equal(t, 4, len(page.Items))
+	assert.Equal(t, "http://pie.com", page.Items[0].Url)
+
+	// cursors only work for the order they came from
+	page, err = db.Page(ctx, PageRequest{Sort: SortRecent, Count: 1})
+	assert.NilError(t, err)
+	_, err = db.Page(ctx, PageRequest{Sort: SortAdded, Count: 1, Cursor: page.NextCursor})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = db.Page(ctx, PageRequest{Sort: SortAdded, Count: 1, Cursor: "garbage"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestBookmarksHandler(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	for i := range 3 {
+		assert.NilError(t, db.Insert(ctx, fmt.Sprintf("http://example%d.com", i), BookmarkData{Title: "example"}))
+	}
+
+	get := func(params url.Values, expStatus int) bookmarkPageStruct {
+		req := httptest.NewRequest(http.MethodGet, "/api/bookmarks?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		fetchBookmarks(db)(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, expStatus, resp.StatusCode)
+		var page bookmarkPageStruct
+		if expStatus == http.StatusOK {
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(&page))
+		}
+		return page
+	}
+
+	page := get(url.Values{"count": {"2"}, "sort": {"alphabetical"}}, http.StatusOK)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, "http://example0.com", page.Items[0].Url)
+	cursor := page.NextCursor
+	page = get(url.Values{"count": {"2"}, "sort": {"alphabetical"}, "cursor": {cursor}}, http.StatusOK)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "http://example2.com", page.Items[0].Url)
+	assert.Equal(t, "", page.NextCursor)
+
+	get(url.Values{"sort": {"sideways"}}, http.StatusBadRequest)
+	get(url.Values{"count": {"-1"}}, http.StatusBadRequest)
+	get(url.Values{"cursor": {"garbage"}}, http.StatusBadRequest)
+	get(url.Values{"q": {"example"}, "sort": {"relevance"}, "cursor": {cursor}}, http.StatusBadRequest)
+	get(url.Values{"q": {`"oops`}}, http.StatusBadRequest)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A subset of the Pinboard v1 API (https://pinboard.in/api/), so that
+// clients written for Pinboard can be pointed at this server instead.
+// Pinboard's "description" is our title and its "extended" is our notes.
+
+// The time format Pinboard uses throughout
+const pinboardTime = "2006-01-02T15:04:05Z"
+
+const pinboardDate = "2006-01-02"
+
+type pinboardPost struct {
+	Href        string `xml:"href,attr" json:"href"`
+	Description string `xml:"description,attr" json:"description"`
+	Extended    string `xml:"extended,attr" json:"extended"`
+	Meta        string `xml:"meta,attr" json:"meta"`
+	Hash        string `xml:"hash,attr" json:"hash"`
+	Time        string `xml:"time,attr" json:"time"`
+	Shared      string `xml:"shared,attr" json:"shared"`
+	ToRead      string `xml:"toread,attr" json:"toread"`
+	Tags        string `xml:"tag,attr" json:"tags"`
+}
+
+type pinboardPosts struct {
+	XMLName xml.Name       `xml:"posts" json:"-"`
+	Date    string         `xml:"dt,attr,omitempty" json:"date"`
+	User    string         `xml:"user,attr" json:"user"`
+	Posts   []pinboardPost `xml:"post" json:"posts"`
+}
+
+type pinboardResult struct {
+	XMLName xml.Name `xml:"result" json:"-"`
+	Code    string   `xml:"code,attr" json:"result_code"`
+}
+
+type pinboardUpdate struct {
+	XMLName xml.Name `xml:"update" json:"-"`
+	Time    string   `xml:"time,attr" json:"update_time"`
+}
+
+type pinboardTag struct {
+	Count int    `xml:"count,attr"`
+	Tag   string `xml:"tag,attr"`
+}
+
+type pinboardTags struct {
+	XMLName xml.Name      `xml:"tags"`
+	Tags    []pinboardTag `xml:"tag"`
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// When a bookmark was added, as far as is known
+func postTime(bookmark ExportedBookmark) time.Time {
+	if bookmark.Added.IsZero() {
+		return bookmark.LastAccess
+	}
+	return bookmark.Added
+}
+
+func newPinboardPost(bookmark ExportedBookmark) pinboardPost {
+	tags := strings.Join(bookmark.Tags, " ")
+	return pinboardPost{
+		Href:        bookmark.Url,
+		Description: bookmark.Title,
+		Extended:    bookmark.Notes,
+		Meta:        md5Hex(bookmark.Title + "\x00" + bookmark.Notes + "\x00" + tags),
+		Hash:        md5Hex(bookmark.Url),
+		Time:        postTime(bookmark).UTC().Format(pinboardTime),
+		Shared:      "no",
+		ToRead:      "no",
+		Tags:        tags,
+	}
+}
+
+func newPinboardPosts(bookmarks []ExportedBookmark) []pinboardPost {
+	posts := []pinboardPost{}
+	for _, bookmark := range bookmarks {
+		posts = append(posts, newPinboardPost(bookmark))
+	}
+	return posts
+}
+
+// Writes a response as XML, or as JSON if the client asked for it
+func pinboardWrite(w http.ResponseWriter, r *http.Request, xmlValue any, jsonValue any) {
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jsonValue)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(xmlValue)
+}
+
+func pinboardWriteResult(w http.ResponseWriter, r *http.Request, code string) {
+	result := pinboardResult{Code: code}
+	pinboardWrite(w, r, result, result)
+}
+
+// Splits a tag parameter, which Pinboard clients separate with spaces or,
+// in some older clients, commas
+func pinboardTagParam(value string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		tags = append(tags, strings.ToLower(tag))
+	}
+	return tags
+}
+
+// Asks for the bookmarks behind a list of posts
+type PostsRequest struct {
+	// Bookmarks carrying every one of these tags
+	Tags []string
+	// Bookmarks added from this time up to and including To, with zero
+	// times leaving the range open at that end
+	From time.Time
+	To   time.Time
+	// Bookmarks skipped, newest first, and then how many to return, or all
+	// of the rest if Count is negative
+	Start int
+	Count int
+}
+
+// Pinboard clients pass "username:TOKEN" as the auth_token parameter. The
+// token can be one made with the token command, which says whose bookmarks
+// to use, or the one configured for the Pinboard api, which stands for the
+// default user whatever the username.
+func pinboardAuth(db Db, token string, next func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request) {
+	tokens := &tokenAuth{db}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, secret, ok := strings.Cut(r.FormValue("auth_token"), ":")
+		if !ok {
+			logError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			next(w, r, user)
+			return
+		}
+		user, err := tokens.check(r.Context(), secret)
+		if errors.Is(err, ErrBadCredentials) {
+			logError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error authenticating: %v", err), http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(withUser(r.Context(), user)), user)
+	}
+}
+
+func pinboardUpdateTime(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		// there's no record of when bookmarks were last edited, so this
+		// only moves on when one is added
+		latest, err := db.LastAdded(r.Context())
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		update := pinboardUpdate{Time: latest.UTC().Format(pinboardTime)}
+		pinboardWrite(w, r, update, update)
+	}
+}
+
+func pinboardAdd(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		bookmarkUrl := r.FormValue("url")
+		title := r.FormValue("description")
+		notes := r.FormValue("extended")
+		tags := pinboardTagParam(r.FormValue("tags"))
+		if bookmarkUrl == "" {
+			pinboardWriteResult(w, r, "missing url")
+			return
+		}
+		if title == "" {
+			pinboardWriteResult(w, r, "missing description")
+			return
+		}
+		u, err := url.Parse(bookmarkUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			pinboardWriteResult(w, r, "invalid url")
+			return
+		}
+		bookmarkUrl = db.NormalizeUrl(bookmarkUrl)
+		added := time.Now()
+		if dt := r.FormValue("dt"); dt != "" {
+			added, err = time.Parse(time.RFC3339, dt)
+			if err != nil {
+				pinboardWriteResult(w, r, "invalid dt")
+				return
+			}
+		}
+
+		err = db.Import(r.Context(), ImportedBookmark{
+			Url:          bookmarkUrl,
+			BookmarkData: BookmarkData{Title: title, Notes: notes},
+			Tags:         tags,
+			Added:        added,
+			LastAccess:   time.Now(),
+		})
+		if errors.Is(err, ErrExists) {
+			if r.FormValue("replace") == "no" {
+				pinboardWriteResult(w, r, "item already exists")
+				return
+			}
+			err = pinboardReplace(r.Context(), db, bookmarkUrl, title, notes, tags)
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error adding bookmark: %v", err), http.StatusInternalServerError)
+			return
+		}
+		pinboardWriteResult(w, r, "done")
+	}
+}
+
+// Updates an existing bookmark to match a repeated add, as Pinboard does
+func pinboardReplace(ctx context.Context, db Db, url string, title string, notes string, tags []string) error {
+	existing, err := db.Bookmark(ctx, url)
+	if err != nil {
+		return err
+	}
+	err = db.Update(ctx, url, BookmarkPatch{Title: &title, Notes: &notes})
+	if err != nil {
+		return err
+	}
+	for _, tag := range existing.Tags {
+		if !slices.Contains(tags, tag) {
+			err = db.RemoveTag(ctx, url, tag)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, tag := range tags {
+		err = db.AddTag(ctx, url, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pinboardDelete(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		err := db.Delete(r.Context(), r.FormValue("url"))
+		if errors.Is(err, ErrNotFound) {
+			pinboardWriteResult(w, r, "item not found")
+			return
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error deleting bookmark: %v", err), http.StatusInternalServerError)
+			return
+		}
+		pinboardWriteResult(w, r, "done")
+	}
+}
+
+// Returns the bookmarks added on one day, the most recent day with any by
+// default, or the one with a given url
+func pinboardGet(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		var bookmarks []ExportedBookmark
+		var err error
+		date := r.FormValue("dt")
+		if bookmarkUrl := r.FormValue("url"); bookmarkUrl != "" {
+			var bookmark ExportedBookmark
+			bookmark, err = db.Bookmark(r.Context(), bookmarkUrl)
+			if err == nil {
+				bookmarks = append(bookmarks, bookmark)
+			} else if errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+		} else {
+			var day time.Time
+			if date != "" {
+				day, err = time.Parse(pinboardDate, date)
+				if err != nil {
+					logError(w, fmt.Sprintf("Invalid dt: %s", date), http.StatusBadRequest)
+					return
+				}
+			}
+			tags := pinboardTagParam(r.FormValue("tag"))
+			if day.IsZero() {
+				// the day of the newest bookmark
+				var newest []ExportedBookmark
+				newest, err = db.Posts(r.Context(), PostsRequest{Tags: tags, Count: 1})
+				if len(newest) > 0 {
+					date = postTime(newest[0]).UTC().Format(pinboardDate)
+					day, err = time.Parse(pinboardDate, date)
+				}
+			}
+			if !day.IsZero() && err == nil {
+				bookmarks, err = db.Posts(r.Context(), PostsRequest{Tags: tags, From: day, To: day.AddDate(0, 0, 1).Add(-time.Second), Count: -1})
+			}
+		}
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		posts := pinboardPosts{Date: date, User: user, Posts: newPinboardPosts(bookmarks)}
+		pinboardWrite(w, r, posts, posts)
+	}
+}
+
+func pinboardRecent(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		count := 15
+		if value := r.FormValue("count"); value != "" {
+			var err error
+			count, err = strconv.Atoi(value)
+			if err != nil || count < 1 || count > 100 {
+				logError(w, fmt.Sprintf("Invalid count: %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+		bookmarks, err := db.Posts(r.Context(), PostsRequest{Tags: pinboardTagParam(r.FormValue("tag")), Count: count})
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		date := ""
+		if len(bookmarks) > 0 {
+			date = postTime(bookmarks[0]).UTC().Format(pinboardTime)
+		}
+		posts := pinboardPosts{Date: date, User: user, Posts: newPinboardPosts(bookmarks)}
+		pinboardWrite(w, r, posts, posts)
+	}
+}
+
+func pinboardAll(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		var from, to time.Time
+		var err error
+		if value := r.FormValue("fromdt"); value != "" {
+			from, err = time.Parse(time.RFC3339, value)
+		}
+		if value := r.FormValue("todt"); value != "" && err == nil {
+			to, err = time.Parse(time.RFC3339, value)
+		}
+		start, results := 0, -1
+		if value := r.FormValue("start"); value != "" && err == nil {
+			start, err = strconv.Atoi(value)
+		}
+		if value := r.FormValue("results"); value != "" && err == nil {
+			results, err = strconv.Atoi(value)
+		}
+		if err != nil || start < 0 {
+			logError(w, "Invalid parameters", http.StatusBadRequest)
+			return
+		}
+
+		bookmarks, err := db.Posts(r.Context(), PostsRequest{
+			Tags:  pinboardTagParam(r.FormValue("tag")),
+			From:  from,
+			To:    to,
+			Start: start,
+			Count: results,
+		})
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		posts := newPinboardPosts(bookmarks)
+		pinboardWrite(w, r, pinboardPosts{User: user, Posts: posts}, posts)
+	}
+}
+
+func pinboardTagCounts(db Db) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, user string) {
+		tags, err := db.Tags(r.Context())
+		if err != nil {
+			logError(w, fmt.Sprintf("Error reading tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		xmlTags := pinboardTags{Tags: []pinboardTag{}}
+		jsonTags := make(map[string]int)
+		for _, tag := range tags {
+			xmlTags.Tags = append(xmlTags.Tags, pinboardTag{tag.Count, tag.Name})
+			jsonTags[tag.Name] = tag.Count
+		}
+		pinboardWrite(w, r, xmlTags, jsonTags)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const pinboardTestToken = "secret"
+
+// Makes a Pinboard api request, returning the response body
+func pinboardTest(t *testing.T, db Db, handler func(http.ResponseWriter, *http.Request, string), params url.Values, expStatus int) []byte {
+	if params.Get("auth_token") == "" {
+		params.Set("auth_token", "user:"+pinboardTestToken)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	pinboardAuth(db, pinboardTestToken, handler)(w, req)
+	resp := w.Result()
+	assert.Equal(t, expStatus, resp.StatusCode)
+	return w.Body.Bytes()
+}
+
+func pinboardResultTest(t *testing.T, db Db, handler func(http.ResponseWriter, *http.Request, string), params url.Values, expCode string) {
+	params.Set("format", "json")
+	var result pinboardResult
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, handler, params, http.StatusOK), &result))
+	assert.Equal(t, expCode, result.Code)
+}
+
+func TestPinboard(t *testing.T) {
+	db, err := NewTestDb()
+	assert.NilError(t, err)
+
+	pinboardTest(t, db, pinboardRecent(db), url.Values{"auth_token": {"user:wrong"}}, http.StatusUnauthorized)
+	pinboardTest(t, db, pinboardRecent(db), url.Values{"auth_token": {"secret"}}, http.StatusUnauthorized)
+
+	// tokens from the token command work too, and say who the user is
+	_, token, err := createToken(context.Background(), db, "alice")
+	assert.NilError(t, err)
+	var recent pinboardPosts
+	assert.NilError(t, xml.Unmarshal(pinboardTest(t, db, pinboardRecent(db), url.Values{"auth_token": {"whoever:" + token}}, http.StatusOK), &recent))
+	assert.Equal(t, "alice", recent.User)
+
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{
+		"url": {"https://go.dev/"}, "description": {"Go"}, "extended": {"a language"},
+		"tags": {"Programming languages"}, "dt": {"2020-01-02T03:04:05Z"},
+	}, "done")
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{
+		"url": {"https://example.com/"}, "description": {"Example"},
+	}, "done")
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{"url": {"https://go.dev/"}, "description": {"Go"}, "replace": {"no"}}, "item already exists")
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{"url": {"https://go.dev/"}}, "missing description")
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{"url": {"ftp://go.dev/"}, "description": {"Go"}}, "invalid url")
+
+	// getting by url, as XML
+	var posts pinboardPosts
+	assert.NilError(t, xml.Unmarshal(pinboardTest(t, db, pinboardGet(db), url.Values{"url": {"https://go.dev/"}}, http.StatusOK), &posts))
+	assert.Equal(t, 1, len(posts.Posts))
+	assert.Equal(t, "user", posts.User)
+	assert.DeepEqual(t, pinboardPost{
+		Href: "https://go.dev", Description: "Go", Extended: "a language",
+		Meta: posts.Posts[0].Meta, Hash: md5Hex("https://go.dev"), Time: "2020-01-02T03:04:05Z",
+		Shared: "no", ToRead: "no", Tags: "languages programming",
+	}, posts.Posts[0])
+
+	// getting by day
+	posts = pinboardPosts{}
+	assert.NilError(t, xml.Unmarshal(pinboardTest(t, db, pinboardGet(db), url.Values{"dt": {"2020-01-02"}}, http.StatusOK), &posts))
+	assert.Equal(t, 1, len(posts.Posts))
+	assert.Equal(t, "2020-01-02", posts.Date)
+
+	// a repeated add replaces the bookmark, however the url is written
+	pinboardResultTest(t, db, pinboardAdd(db), url.Values{"url": {"https://go.dev/?utm_source=feed"}, "description": {"Go!"}, "tags": {"go,programming"}}, "done")
+
+	// newest first
+	posts = pinboardPosts{}
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, pinboardRecent(db), url.Values{"format": {"json"}}, http.StatusOK), &posts))
+	assert.Equal(t, 2, len(posts.Posts))
+	assert.Equal(t, "https://example.com", posts.Posts[0].Href)
+	assert.Equal(t, "Go!", posts.Posts[1].Description)
+	assert.Equal(t, "go programming", posts.Posts[1].Tags)
+
+	var all []pinboardPost
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, pinboardAll(db), url.Values{"format": {"json"}, "tag": {"go"}}, http.StatusOK), &all))
+	assert.Equal(t, 1, len(all))
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, pinboardAll(db), url.Values{"format": {"json"}, "todt": {"2021-01-01T00:00:00Z"}}, http.StatusOK), &all))
+	assert.Equal(t, 1, len(all))
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, pinboardAll(db), url.Values{"format": {"json"}, "start": {"1"}}, http.StatusOK), &all))
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, "https://go.dev", all[0].Href)
+
+	var tags map[string]int
+	assert.NilError(t, json.Unmarshal(pinboardTest(t, db, pinboardTagCounts(db), url.Values{"format": {"json"}}, http.StatusOK), &tags))
+	assert.DeepEqual(t, map[string]int{"go": 1, "programming": 1}, tags)
+
+	var update pinboardUpdate
+	assert.NilError(t, xml.Unmarshal(pinboardTest(t, db, pinboardUpdateTime(db), url.Values{}, http.StatusOK), &update))
+	assert.Assert(t, update.Time > "2020-01-02T03:04:05Z")
+
+	pinboardResultTest(t, db, pinboardDelete(db), url.Values{"url": {"https://go.dev/"}}, "done")
+	pinboardResultTest(t, db, pinboardDelete(db), url.Values{"url": {"https://go.dev/"}}, "item not found")
+}
+
+func TestPosts(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+	for i, day := range []string{"2020-01-01", "2020-01-02", "2020-01-02", "2020-01-03"} {
+		added, err := time.Parse(pinboardDate, day)
+		assert.NilError(t, err)
+		tags := []string{"all"}
+		if i%2 == 0 {
+			tags = append(tags, "even")
+		}
+		assert.NilError(t, db.Import(ctx, ImportedBookmark{
+			Url:          fmt.Sprintf("http://example.com/%d", i),
+			BookmarkData: BookmarkData{Title: day, Icon: []byte("icon"), IconType: "image/png"},
+			Tags:         tags,
+			Added:        added.Add(time.Duration(i) * time.Hour),
+			LastAccess:   added,
+		}))
+	}
+	urls := func(req PostsRequest) []string {
+		posts, err := db.Posts(ctx, req)
+		assert.NilError(t, err)
+		var urls []string
+		for _, post := range posts {
+			// icons are left behind
+			assert.Assert(t, post.Icon == nil)
+			urls = append(urls, post.Url)
+		}
+		return urls
+	}
+
+	assert.DeepEqual(t, []string{"http://example.com/3", "http://example.com/2"}, urls(PostsRequest{Count: 2}))
+	assert.DeepEqual(t, []string{"http://example.com/1", "http://example.com/0"}, urls(PostsRequest{Start: 2, Count: -1}))
+	assert.DeepEqual(t, []string{"http://example.com/2", "http://example.com/0"}, urls(PostsRequest{Tags: []string{"all", "even"}, Count: -1}))
+	assert.DeepEqual(t, []string{"http://example.com/2", "http://example.com/1"}, urls(PostsRequest{
+		From:  time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		To:    time.Date(2020, 1, 2, 23, 59, 59, 0, time.UTC),
+		Count: -1,
+	}))
+
+	latest, err := db.LastAdded(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, time.Date(2020, 1, 3, 3, 0, 0, 0, time.UTC), latest)
+	latest, err = db.LastAdded(withUser(ctx, "bob"))
+	assert.NilError(t, err)
+	assert.Assert(t, latest.IsZero())
+}
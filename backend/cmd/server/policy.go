@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Returned when the fetcher refuses to retrieve a url, so that the add page
+// can't be used to probe the network the server sits on
+type PolicyError struct {
+	Url    string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("fetching %s is not allowed: %s", e.Url, e.Reason)
+}
+
+// Address ranges that aren't on the public internet, beyond those the netip
+// methods in isPublic already cover
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("100::/64"),       // discard
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64, likewise
+	netip.MustParsePrefix("2001::/32"),      // Teredo, likewise
+	netip.MustParsePrefix("2002::/16"),      // 6to4, likewise
+}
+
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decides which urls the fetcher may retrieve
+type fetchPolicy struct {
+	// non-public ranges that may be fetched from anyway
+	allowed []netip.Prefix
+}
+
+// Only plain web urls can be bookmarked
+func (policy *fetchPolicy) checkUrl(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &PolicyError{u.String(), fmt.Sprintf("scheme %q is not http or https", u.Scheme)}
+	}
+	if u.Hostname() == "" {
+		return &PolicyError{u.String(), "no host"}
+	}
+	return nil
+}
+
+// Checks an address that is about to be connected to. This runs after DNS
+// resolution for every connection the transport makes, so it also covers
+// each redirect hop and hosts whose DNS changes between lookups.
+func (policy *fetchPolicy) checkAddress(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &PolicyError{address, "unparseable address"}
+	}
+	return policy.checkAddr(addrPort.Addr(), address)
+}
+
+func (policy *fetchPolicy) checkAddr(addr netip.Addr, label string) error {
+	addr = addr.Unmap()
+	if isPublic(addr) {
+		return nil
+	}
+	for _, prefix := range policy.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return &PolicyError{label, "address is not on the public internet"}
+}
+
+// Checks a url ahead of fetching it, resolving its host so that names
+// pointing into the local network can be refused up front. Lookup failures
+// aren't reported, since they may be temporary, and the address will be
+// checked again when it is connected to anyway.
+func (policy *fetchPolicy) checkHost(ctx context.Context, u *url.URL) error {
+	err := policy.checkUrl(u)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		err = policy.checkAddr(addr, u.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For use as net.Dialer.Control
+func (policy *fetchPolicy) control(network, address string, _ syscall.RawConn) error {
+	return policy.checkAddress(address)
+}
+
+// Returns a dialer that enforces the policy
+func (policy *fetchPolicy) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   policy.control,
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCheckAddress(t *testing.T) {
+	policy := &fetchPolicy{allowed: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}}
+	var policyErr *PolicyError
+
+	for _, address := range []string{
+		"93.184.215.14:443",
+		"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:80",
+		// allowlisted
+		"192.168.1.20:80",
+	} {
+		assert.NilError(t, policy.checkAddress(address), address)
+	}
+
+	for _, address := range []string{
+		"127.0.0.1:80",
+		"[::1]:80",
+		"0.0.0.0:80",
+		"10.1.2.3:80",
+		"172.16.0.1:80",
+		"192.168.2.1:80",
+		"169.254.169.254:80",
+		"100.64.0.1:80",
+		"224.0.0.1:80",
+		"255.255.255.255:80",
+		"[fd00::1]:80",
+		"[fe80::1]:80",
+		"[::ffff:127.0.0.1]:80",
+		"[::ffff:10.0.0.1]:80",
+		"[64:ff9b::7f00:1]:80",
+		"[2002:7f00:1::]:80",
+		"not an address",
+	} {
+		assert.Assert(t, errors.As(policy.checkAddress(address), &policyErr), address)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Describes a search query that can't be understood
+type QueryError struct {
+	Message string `json:"error"`
+	// Byte offset into the query of the part that is wrong
+	Position int `json:"position"`
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", err.Message, err.Position)
+}
+
+// A word or phrase to look for in the full text index
+type queryTerm struct {
+	text    string
+	exclude bool
+	prefix  bool
+}
+
+// A restriction on which bookmarks match, as a SQL condition on the
+// bookmarks table b
+type queryFilter struct {
+	where string
+	args  []any
+}
+
+// A parsed search query
+type searchQuery struct {
+	terms   []queryTerm
+	filters []queryFilter
+}
+
+// Parses a search query. Words and "quoted phrases" are looked for in the
+// full text index, and a leading - excludes them instead. These narrow the
+// search further, and can also be negated with -:
+//
+//	site:example.com  bookmarks on the host or its subdomains
+//	tag:name          bookmarks with the tag
+//	is:favorite       favorites (is:fav for short)
+//	after:2006-01-02  bookmarks added on or after the date
+//	before:2006-01-02 bookmarks added before the date
+//
+// If the query ends part way through a word, the word is treated as a
+// prefix, so that results appear while typing.
+func parseQuery(query string) (searchQuery, error) {
+	var result searchQuery
+	pos := 0
+	for {
+		for pos < len(query) {
+			r, size := utf8.DecodeRuneInString(query[pos:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			pos += size
+		}
+		if pos == len(query) {
+			break
+		}
+
+		start := pos
+		exclude := false
+		if query[pos] == '-' {
+			exclude = true
+			pos++
+		}
+		if r, _ := utf8.DecodeRuneInString(query[pos:]); pos == len(query) || unicode.IsSpace(r) {
+			return result, &QueryError{"nothing to exclude after -", start}
+		}
+
+		if query[pos] == '"' {
+			phrase, end, err := readQuoted(query, pos)
+			if err != nil {
+				return result, err
+			}
+			pos = end
+			result.terms = append(result.terms, queryTerm{text: phrase, exclude: exclude})
+			continue
+		}
+
+		end := pos
+		for end < len(query) {
+			r, size := utf8.DecodeRuneInString(query[end:])
+			if unicode.IsSpace(r) || r == '"' {
+				break
+			}
+			end += size
+		}
+		word := query[pos:end]
+		pos = end
+
+		field, value, ok := strings.Cut(word, ":")
+		field = strings.ToLower(field)
+		if !ok || !isQueryField(field) {
+			lastRune, _ := utf8.DecodeLastRuneInString(word)
+			result.terms = append(result.terms, queryTerm{
+				text:    word,
+				exclude: exclude,
+				prefix:  !exclude && pos == len(query) && unicode.IsLetter(lastRune),
+			})
+			continue
+		}
+		if value == "" && pos < len(query) && query[pos] == '"' {
+			var err error
+			value, pos, err = readQuoted(query, pos)
+			if err != nil {
+				return result, err
+			}
+		}
+		if value == "" {
+			return result, &QueryError{fmt.Sprintf("%s: needs a value", field), start}
+		}
+		filter, err := fieldFilter(field, value)
+		if err != nil {
+			return result, &QueryError{err.Error(), start}
+		}
+		if exclude {
+			filter.where = "NOT " + filter.where
+		}
+		result.filters = append(result.filters, filter)
+	}
+	return result, nil
+}
+
+// Reads a double-quoted string starting at pos, returning its contents and
+// the position just after it
+func readQuoted(query string, pos int) (string, int, error) {
+	end := strings.IndexByte(query[pos+1:], '"')
+	if end < 0 {
+		return "", 0, &QueryError{"unterminated quote", pos}
+	}
+	return query[pos+1 : pos+1+end], pos + end + 2, nil
+}
+
+func isQueryField(field string) bool {
+	switch field {
+	case "site", "tag", "is", "after", "before":
+		return true
+	}
+	return false
+}
+
+// The host part of a bookmark's url, including any port
+const urlHost = `(CASE WHEN instr(substr(b.url, instr(b.url, '://') + 3), '/') > 0
+		THEN substr(b.url, instr(b.url, '://') + 3, instr(substr(b.url, instr(b.url, '://') + 3), '/') - 1)
+		ELSE substr(b.url, instr(b.url, '://') + 3) END)`
+
+// Escapes the wildcards in a LIKE pattern, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func fieldFilter(field string, value string) (queryFilter, error) {
+	switch field {
+	case "site":
+		// the host itself or any subdomain, with or without a port
+		site := strings.ToLower(strings.TrimPrefix(value, "."))
+		return queryFilter{`('.' || lower(` + urlHost + `) || ':' LIKE ? ESCAPE '\')`,
+			[]any{"%." + escapeLike(site) + ":%"}}, nil
+	case "tag":
+		tag, err := normalizeTag(value)
+		if err != nil {
+			return queryFilter{}, err
+		}
+		return queryFilter{`b.id IN (SELECT bt.bookmark FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE t.name = ?)`,
+			[]any{tag}}, nil
+	case "is":
+		switch strings.ToLower(value) {
+		case "favorite", "fav":
+			return queryFilter{"b.favorite = 1", nil}, nil
+		case "broken":
+			return queryFilter{"b.id IN (SELECT c.bookmark FROM link_checks c WHERE " + brokenLink + ")", nil}, nil
+		case "moved":
+			return queryFilter{"b.id IN (SELECT c.bookmark FROM link_checks c WHERE " + movedLink + ")", nil}, nil
+		}
+		return queryFilter{}, fmt.Errorf("unknown is: filter %q", value)
+	case "after", "before":
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return queryFilter{}, fmt.Errorf("%s: expects a date like 2006-01-02", field)
+		}
+		op := ">="
+		if field == "before" {
+			op = "<"
+		}
+		return queryFilter{"b.added " + op + " ?", []any{date.Format(time.DateOnly)}}, nil
+	}
+	return queryFilter{}, fmt.Errorf("unknown field %s:", field)
+}
+
+// Returns the full text expression for the words and phrases to look for,
+// or "" if there are none
+func (query searchQuery) match() string {
+	return query.ftsExpr(false)
+}
+
+// Returns the full text expression for the words and phrases to exclude, or
+// "" if there are none
+func (query searchQuery) excluded() string {
+	return query.ftsExpr(true)
+}
+
+func (query searchQuery) ftsExpr(exclude bool) string {
+	var parts []string
+	for _, term := range query.terms {
+		if term.exclude != exclude {
+			continue
+		}
+		// quoting everything keeps FTS5 from seeing syntax in the query
+		part := `"` + strings.ReplaceAll(term.text, `"`, `""`) + `"`
+		if term.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	if exclude {
+		return strings.Join(parts, " OR ")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reports whether the query has anything in it
+func (query searchQuery) empty() bool {
+	return len(query.terms) == 0 && len(query.filters) == 0
+}
+
+// The markers put around matches by highlight() and snippet(), which are
+// unlikely to appear in real text
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// The fts columns holding the title and the notes
+const (
+	titleColumn = 1
+	notesColumn = 4
+)
+
+// Extra columns for search results, read by scanSearchResults
+var highlightColumns = fmt.Sprintf(`highlight(fts, %d, char(2), char(3)), snippet(fts, %d, char(2), char(3), '…', 16)`,
+	titleColumn, notesColumn)
+
+// Turns text marked up by highlight() or snippet() into the text and the
+// ranges that matched
+func parseHighlight(marked string) *highlightedText {
+	result := &highlightedText{Matches: []matchRange{}}
+	var text strings.Builder
+	pos := 0
+	start := -1
+	for _, r := range marked {
+		switch string(r) {
+		case matchStart:
+			start = pos
+		case matchEnd:
+			if start >= 0 {
+				result.Matches = append(result.Matches, matchRange{start, pos})
+				start = -1
+			}
+		default:
+			text.WriteRune(r)
+			pos += utf16.RuneLen(r)
+		}
+	}
+	result.Text = text.String()
+	return result
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		err   QueryError
+	}{
+		{`"unterminated`, QueryError{"unterminated quote", 0}},
+		{`food site:"example.com`, QueryError{"unterminated quote", 10}},
+		{`food -`, QueryError{"nothing to exclude after -", 5}},
+		{`tag:`, QueryError{"tag: needs a value", 0}},
+		{`is:lost`, QueryError{`unknown is: filter "lost"`, 0}},
+		{`after:yesterday`, QueryError{"after: expects a date like 2006-01-02", 0}},
+	} {
+		_, err := parseQuery(test.query)
+		queryErr, ok := err.(*QueryError)
+		assert.Assert(t, ok, "%s: %v", test.query, err)
+		assert.Equal(t, test.err, *queryErr)
+	}
+
+	// fts syntax is just text
+	query, err := parseQuery(`foo:bar AND (NEAR x^ y)`)
+	assert.NilError(t, err)
+	assert.Equal(t, `"foo:bar" "AND" "(NEAR" "x^" "y)"`, query.match())
+}
+
+func TestSearchSyntax(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	_, err := db.db.Exec(`INSERT INTO bookmarks (owner, url, title, lastAccess, added, favorite) VALUES
+			(1, 'https://github.com/golang/go', 'the go programming language', '2025-03-01', '2024-06-01', 1),
+			(1, 'https://gist.github.com/someone/1', 'go snippet', '2025-03-02', '2025-01-15', 0),
+			(1, 'http://notgithub.com:8080/go', 'go elsewhere', '2025-03-03', '2025-02-01', 0),
+			(1, 'https://example.com/', 'example programming', '2025-03-04', '2025-02-02', 0)`)
+	assert.NilError(t, err)
+	assert.NilError(t, db.AddTag(ctx, "https://github.com/golang/go", "Go"))
+	assert.NilError(t, db.AddTag(ctx, "https://example.com/", "go"))
+
+	for _, test := range []struct {
+		query string
+		urls  []string
+	}{
+		{"site:github.com", []string{"https://gist.github.com/someone/1", "https://github.com/golang/go"}},
+		{"site:GIST.github.com go", []string{"https://gist.github.com/someone/1"}},
+		{"site:notgithub.com", []string{"http://notgithub.com:8080/go"}},
+		{"go -site:github.com", []string{"http://notgithub.com:8080/go", "https://example.com/"}},
+		{"tag:go programming", []string{"https://example.com/", "https://github.com/golang/go"}},
+		{"-tag:go", []string{"http://notgithub.com:8080/go", "https://gist.github.com/someone/1"}},
+		{"is:fav", []string{"https://github.com/golang/go"}},
+		{"go -is:favorite -snippet", []string{"http://notgithub.com:8080/go", "https://example.com/"}},
+		{"after:2025-01-15 before:2025-02-02", []string{"http://notgithub.com:8080/go", "https://gist.github.com/someone/1"}},
+		{`"go programming" -"go snippet"`, []string{"https://github.com/golang/go"}},
+		{"-go", nil},
+		{"tag:rust", nil},
+	} {
+		results, err := db.Search(ctx, test.query)
+		assert.NilError(t, err, test.query)
+		var urls []string
+		for _, result := range results {
+			urls = append(urls, result.Url)
+		}
+		assert.Equal(t, strings.Join(test.urls, " "), strings.Join(urls, " "), test.query)
+	}
+
+	_, err = db.Search(ctx, `site:`)
+	assert.ErrorContains(t, err, "site: needs a value")
+}
+
+func TestSearchHighlights(t *testing.T) {
+	db := setupTest(t)
+	ctx := context.Background()
+
+	assert.NilError(t, db.Insert(ctx, "http://example.com", BookmarkData{
+		Title: "🍅 Growing tomatoes",
+		Notes: "Start them indoors in early spring, then plant out tomatoes once the nights are warm. Water deeply and not too often.",
+	}))
+	assert.NilError(t, db.Insert(ctx, "http://example2.com", BookmarkData{Title: "Tomato soup"}))
+
+	results, err := db.Search(ctx, "tomato")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.DeepEqual(t, &highlightedText{"Tomato soup", []matchRange{{0, 6}}}, results[0].TitleHighlight)
+	assert.Assert(t, results[0].Snippet == nil)
+	// the emoji is two code units
+	assert.DeepEqual(t, &highlightedText{"🍅 Growing tomatoes", []matchRange{{11, 19}}}, results[1].TitleHighlight)
+	assert.DeepEqual(t, &highlightedText{
+		"Start them indoors in early spring, then plant out tomatoes once the nights are warm. Water…",
+		[]matchRange{{51, 59}},
+	}, results[1].Snippet)
+
+	// notes that don't match still give a snippet
+	results, err = db.Search(ctx, "growing")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, 0, len(results[0].Snippet.Matches))
+
+	// nothing to highlight without any words
+	results, err = db.Search(ctx, "site:example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Assert(t, results[0].TitleHighlight == nil)
+}
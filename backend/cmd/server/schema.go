@@ -81,4 +81,530 @@ END;
 
 INSERT INTO fts(fts) VALUES('rebuild');
 	`,
+	// version 4
+	`
+CREATE TABLE tags (
+  id integer primary key,
+  name text unique
+);
+
+CREATE TABLE bookmark_tags (
+  url text,
+  tag integer,
+  primary key (url, tag)
+);
+
+CREATE INDEX bookmark_tags_tag ON bookmark_tags(tag);
+
+-- Space-separated tag names, denormalized so that fts can index them
+ALTER TABLE bookmarks ADD COLUMN tags text DEFAULT '';
+
+-- Triggers to keep bookmarks.tags up to date.
+CREATE TRIGGER bookmark_tags_ai AFTER INSERT ON bookmark_tags BEGIN
+  UPDATE bookmarks SET tags = (
+    SELECT ifnull(group_concat(name, ' '), '') FROM (
+      SELECT t.name FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE bt.url = new.url ORDER BY t.name
+    )
+  ) WHERE url = new.url;
+END;
+
+CREATE TRIGGER bookmark_tags_ad AFTER DELETE ON bookmark_tags BEGIN
+  UPDATE bookmarks SET tags = (
+    SELECT ifnull(group_concat(name, ' '), '') FROM (
+      SELECT t.name FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE bt.url = old.url ORDER BY t.name
+    )
+  ) WHERE url = old.url;
+  DELETE FROM tags WHERE id = old.tag AND NOT EXISTS (SELECT 1 FROM bookmark_tags WHERE tag = old.tag);
+END;
+
+-- Triggers to keep bookmark_tags following its bookmark.
+CREATE TRIGGER bookmarks_tags_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM bookmark_tags WHERE url = old.url;
+END;
+
+CREATE TRIGGER bookmarks_tags_au AFTER UPDATE OF url ON bookmarks BEGIN
+  UPDATE bookmark_tags SET url = new.url WHERE url = old.url;
+END;
+
+DROP TABLE IF EXISTS fts;
+
+CREATE VIRTUAL TABLE fts USING fts5(
+  url UNINDEXED,
+  title,
+  favorite,
+  tags,
+  content='bookmarks',
+  prefix='1 2 3',
+  tokenize='porter unicode61'
+);
+
+-- Triggers to keep the FTS index up to date.
+DROP TRIGGER IF EXISTS bookmarks_ai;
+CREATE TRIGGER bookmarks_ai AFTER INSERT ON bookmarks BEGIN
+  INSERT INTO fts(rowid, url, title, favorite, tags) VALUES (new.rowid, new.url, new.title, new.favorite, new.tags);
+END;
+
+DROP TRIGGER IF EXISTS bookmarks_ad;
+CREATE TRIGGER bookmarks_ad AFTER DELETE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags) VALUES('delete', old.rowid, old.url, old.title, old.favorite, old.tags);
+END;
+
+DROP TRIGGER IF EXISTS bookmarks_au;
+CREATE TRIGGER bookmarks_au AFTER UPDATE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags) VALUES('delete', old.rowid, old.url, old.title, old.favorite, old.tags);
+  INSERT INTO fts(rowid, url, title, favorite, tags) VALUES (new.rowid, new.url, new.title, new.favorite, new.tags);
+END;
+
+INSERT INTO fts(fts) VALUES('rebuild');
+	`,
+	// version 5
+	`
+ALTER TABLE bookmarks ADD COLUMN notes text DEFAULT '';
+
+DROP TABLE IF EXISTS fts;
+
+CREATE VIRTUAL TABLE fts USING fts5(
+  url UNINDEXED,
+  title,
+  favorite,
+  tags,
+  notes,
+  content='bookmarks',
+  prefix='1 2 3',
+  tokenize='porter unicode61'
+);
+
+-- Triggers to keep the FTS index up to date.
+DROP TRIGGER IF EXISTS bookmarks_ai;
+CREATE TRIGGER bookmarks_ai AFTER INSERT ON bookmarks BEGIN
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes) VALUES (new.rowid, new.url, new.title, new.favorite, new.tags, new.notes);
+END;
+
+DROP TRIGGER IF EXISTS bookmarks_ad;
+CREATE TRIGGER bookmarks_ad AFTER DELETE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes) VALUES('delete', old.rowid, old.url, old.title, old.favorite, old.tags, old.notes);
+END;
+
+DROP TRIGGER IF EXISTS bookmarks_au;
+CREATE TRIGGER bookmarks_au AFTER UPDATE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes) VALUES('delete', old.rowid, old.url, old.title, old.favorite, old.tags, old.notes);
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes) VALUES (new.rowid, new.url, new.title, new.favorite, new.tags, new.notes);
+END;
+
+INSERT INTO fts(fts) VALUES('rebuild');
+	`,
+	// version 6
+	`
+-- Site icons, shared between bookmarks by content hash
+CREATE TABLE icons (
+  hash text primary key,
+  contentType text,
+  data blob
+);
+
+ALTER TABLE bookmarks ADD COLUMN icon text;
+
+CREATE INDEX bookmarks_icon ON bookmarks(icon);
+
+-- Triggers to discard icons no longer used by any bookmark.
+CREATE TRIGGER bookmarks_icon_ad AFTER DELETE ON bookmarks WHEN old.icon IS NOT NULL BEGIN
+  DELETE FROM icons WHERE hash = old.icon AND NOT EXISTS (SELECT 1 FROM bookmarks WHERE icon = old.icon);
+END;
+
+CREATE TRIGGER bookmarks_icon_au AFTER UPDATE OF icon ON bookmarks WHEN old.icon IS NOT NULL BEGIN
+  DELETE FROM icons WHERE hash = old.icon AND NOT EXISTS (SELECT 1 FROM bookmarks WHERE icon = old.icon);
+END;
+	`,
+	// version 7
+	`
+ALTER TABLE bookmarks ADD COLUMN description text DEFAULT '';
+ALTER TABLE bookmarks ADD COLUMN canonicalUrl text DEFAULT '';
+ALTER TABLE bookmarks ADD COLUMN siteName text DEFAULT '';
+ALTER TABLE bookmarks ADD COLUMN imageUrl text DEFAULT '';
+ALTER TABLE bookmarks ADD COLUMN author text DEFAULT '';
+	`,
+	// version 8
+	`
+-- One of 'pending' while the page is being fetched, 'ok' or 'failed'
+ALTER TABLE bookmarks ADD COLUMN status text DEFAULT 'ok';
+
+-- Background fetches of bookmarked pages
+CREATE TABLE jobs (
+  id integer primary key,
+  url text,
+  -- One of 'queued', 'running', 'done' or 'failed'
+  state text,
+  attempts integer DEFAULT 0,
+  nextAttempt datetime,
+  lastError text DEFAULT '',
+  created datetime,
+  updated datetime
+);
+
+CREATE INDEX jobs_ready ON jobs(state, nextAttempt);
+CREATE INDEX jobs_url ON jobs(url);
+
+-- Triggers to keep jobs following their bookmark.
+CREATE TRIGGER bookmarks_jobs_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM jobs WHERE url = old.url;
+END;
+
+CREATE TRIGGER bookmarks_jobs_au AFTER UPDATE OF url ON bookmarks BEGIN
+  UPDATE jobs SET url = new.url WHERE url = old.url;
+END;
+	`,
+	// version 9
+	`
+-- When each bookmark was first added. Until now the best guess is the
+-- last time it was accessed.
+ALTER TABLE bookmarks ADD COLUMN added datetime;
+UPDATE bookmarks SET added = lastAccess;
+	`,
+	// version 10
+	`
+-- API tokens, stored as the hex SHA-256 of the token itself
+CREATE TABLE tokens (
+  id integer primary key,
+  hash text unique,
+  user text,
+  created datetime,
+  lastUsed datetime
+);
+	`,
+	// version 11
+	`
+-- Rebuilding tables, so all or nothing
+BEGIN;
+
+CREATE TABLE users (
+  id integer primary key,
+  name text unique,
+  created datetime
+);
+
+-- Everything from before there were users belongs to the first one
+INSERT INTO users (id, name, created) VALUES (1, 'default', datetime('now'));
+
+-- The old triggers all find bookmarks by url, which is no longer unique.
+DROP TRIGGER bookmarks_ai;
+DROP TRIGGER bookmarks_ad;
+DROP TRIGGER bookmarks_au;
+DROP TRIGGER bookmark_tags_ai;
+DROP TRIGGER bookmark_tags_ad;
+DROP TRIGGER bookmarks_tags_ad;
+DROP TRIGGER bookmarks_tags_au;
+DROP TRIGGER bookmarks_icon_ad;
+DROP TRIGGER bookmarks_icon_au;
+DROP TRIGGER bookmarks_jobs_ad;
+DROP TRIGGER bookmarks_jobs_au;
+
+-- Each user has their own bookmarks, so a url is only unique per owner.
+-- Other tables refer to bookmarks by id, which keeps the old rowid.
+CREATE TABLE bookmarks_new (
+  id integer primary key,
+  owner integer NOT NULL REFERENCES users(id),
+  url text NOT NULL,
+  title text,
+  lastAccess datetime,
+  hitCount integer,
+  favorite integer DEFAULT 0,
+  tags text DEFAULT '',
+  notes text DEFAULT '',
+  icon text,
+  description text DEFAULT '',
+  canonicalUrl text DEFAULT '',
+  siteName text DEFAULT '',
+  imageUrl text DEFAULT '',
+  author text DEFAULT '',
+  status text DEFAULT 'ok',
+  added datetime,
+  UNIQUE (owner, url)
+);
+
+INSERT INTO bookmarks_new (id, owner, url, title, lastAccess, hitCount, favorite, tags, notes, icon,
+                           description, canonicalUrl, siteName, imageUrl, author, status, added)
+  SELECT rowid, 1, url, title, lastAccess, hitCount, favorite, tags, notes, icon,
+         description, canonicalUrl, siteName, imageUrl, author, status, added
+  FROM bookmarks;
+
+DROP TABLE bookmarks;
+ALTER TABLE bookmarks_new RENAME TO bookmarks;
+
+CREATE INDEX bookmarks_icon ON bookmarks(icon);
+
+CREATE TABLE bookmark_tags_new (
+  bookmark integer,
+  tag integer,
+  primary key (bookmark, tag)
+);
+
+INSERT INTO bookmark_tags_new (bookmark, tag)
+  SELECT b.id, bt.tag FROM bookmark_tags bt JOIN bookmarks b ON b.url = bt.url;
+
+DROP TABLE bookmark_tags;
+ALTER TABLE bookmark_tags_new RENAME TO bookmark_tags;
+
+CREATE INDEX bookmark_tags_tag ON bookmark_tags(tag);
+
+CREATE TABLE jobs_new (
+  id integer primary key,
+  bookmark integer,
+  -- One of 'queued', 'running', 'done' or 'failed'
+  state text,
+  attempts integer DEFAULT 0,
+  nextAttempt datetime,
+  lastError text DEFAULT '',
+  created datetime,
+  updated datetime
+);
+
+INSERT INTO jobs_new (id, bookmark, state, attempts, nextAttempt, lastError, created, updated)
+  SELECT j.id, b.id, j.state, j.attempts, j.nextAttempt, j.lastError, j.created, j.updated
+  FROM jobs j JOIN bookmarks b ON b.url = j.url;
+
+DROP TABLE jobs;
+ALTER TABLE jobs_new RENAME TO jobs;
+
+CREATE INDEX jobs_ready ON jobs(state, nextAttempt);
+CREATE INDEX jobs_bookmark ON jobs(bookmark);
+
+-- Triggers to keep the FTS index up to date.
+CREATE TRIGGER bookmarks_ai AFTER INSERT ON bookmarks BEGIN
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes);
+END;
+
+CREATE TRIGGER bookmarks_ad AFTER DELETE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes);
+END;
+
+CREATE TRIGGER bookmarks_au AFTER UPDATE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes);
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes);
+END;
+
+-- Triggers to keep bookmarks.tags up to date.
+CREATE TRIGGER bookmark_tags_ai AFTER INSERT ON bookmark_tags BEGIN
+  UPDATE bookmarks SET tags = (
+    SELECT ifnull(group_concat(name, ' '), '') FROM (
+      SELECT t.name FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE bt.bookmark = new.bookmark ORDER BY t.name
+    )
+  ) WHERE id = new.bookmark;
+END;
+
+CREATE TRIGGER bookmark_tags_ad AFTER DELETE ON bookmark_tags BEGIN
+  UPDATE bookmarks SET tags = (
+    SELECT ifnull(group_concat(name, ' '), '') FROM (
+      SELECT t.name FROM bookmark_tags bt JOIN tags t ON t.id = bt.tag WHERE bt.bookmark = old.bookmark ORDER BY t.name
+    )
+  ) WHERE id = old.bookmark;
+  DELETE FROM tags WHERE id = old.tag AND NOT EXISTS (SELECT 1 FROM bookmark_tags WHERE tag = old.tag);
+END;
+
+-- Triggers to clean up after a bookmark is deleted.
+CREATE TRIGGER bookmarks_tags_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM bookmark_tags WHERE bookmark = old.id;
+END;
+
+CREATE TRIGGER bookmarks_jobs_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM jobs WHERE bookmark = old.id;
+END;
+
+CREATE TRIGGER bookmarks_icon_ad AFTER DELETE ON bookmarks WHEN old.icon IS NOT NULL BEGIN
+  DELETE FROM icons WHERE hash = old.icon AND NOT EXISTS (SELECT 1 FROM bookmarks WHERE icon = old.icon);
+END;
+
+CREATE TRIGGER bookmarks_icon_au AFTER UPDATE OF icon ON bookmarks WHEN old.icon IS NOT NULL BEGIN
+  DELETE FROM icons WHERE hash = old.icon AND NOT EXISTS (SELECT 1 FROM bookmarks WHERE icon = old.icon);
+END;
+
+INSERT INTO fts(fts) VALUES('rebuild');
+
+COMMIT;
+	`,
+	// version 12
+	`
+BEGIN;
+
+-- The words of a bookmark's url worth searching for: the host, without any
+-- www., and the path. That is, the url less its scheme, query and fragment,
+-- which the tokenizer splits on the punctuation.
+ALTER TABLE bookmarks ADD COLUMN urlWords text GENERATED ALWAYS AS (
+  substr(substr(url, 1, instr(replace(url, '#', '?') || '?', '?') - 1),
+    instr(substr(url, 1, instr(replace(url, '#', '?') || '?', '?') - 1), '://') + 3 * (instr(substr(url, 1, instr(replace(url, '#', '?') || '?', '?') - 1), '://') > 0)
+    + 4 * (lower(substr(substr(url, 1, instr(replace(url, '#', '?') || '?', '?') - 1), instr(substr(url, 1, instr(replace(url, '#', '?') || '?', '?') - 1), '://') + 3, 4)) = 'www.'))
+) VIRTUAL;
+
+DROP TRIGGER bookmarks_ai;
+DROP TRIGGER bookmarks_ad;
+DROP TRIGGER bookmarks_au;
+DROP TABLE fts;
+
+CREATE VIRTUAL TABLE fts USING fts5(
+  url UNINDEXED,
+  title,
+  favorite,
+  tags,
+  notes,
+  urlWords,
+  content='bookmarks',
+  prefix='1 2 3',
+  tokenize='porter unicode61'
+);
+
+-- Triggers to keep the FTS index up to date.
+CREATE TRIGGER bookmarks_ai AFTER INSERT ON bookmarks BEGIN
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes, urlWords) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes, new.urlWords);
+END;
+
+CREATE TRIGGER bookmarks_ad AFTER DELETE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes, urlWords) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes, old.urlWords);
+END;
+
+CREATE TRIGGER bookmarks_au AFTER UPDATE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes, urlWords) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes, old.urlWords);
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes, urlWords) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes, new.urlWords);
+END;
+
+INSERT INTO fts(fts) VALUES('rebuild');
+
+COMMIT;
+	`,
+	// version 13
+	`
+BEGIN;
+
+-- Each time a bookmark is opened
+CREATE TABLE visits (
+  id integer primary key,
+  bookmark integer NOT NULL,
+  visited datetime NOT NULL
+);
+
+CREATE INDEX visits_bookmark ON visits(bookmark, visited);
+
+CREATE TRIGGER bookmarks_visits_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM visits WHERE bookmark = old.id;
+END;
+
+-- How much each bookmark is used, the way Firefox works it out: the number
+-- of visits, weighted by how recent the last few of them were. Bookmarks
+-- from before visits were kept count as visited when last accessed.
+CREATE VIEW frecency_scores AS
+SELECT b.id AS bookmark, ifnull(b.hitCount, 0) * ifnull(
+  (SELECT avg(CASE
+      WHEN age <= 4 THEN 100
+      WHEN age <= 14 THEN 70
+      WHEN age <= 31 THEN 50
+      WHEN age <= 90 THEN 30
+      ELSE 10 END)
+    FROM (SELECT julianday('now') - julianday(v.visited) AS age FROM visits v
+          WHERE v.bookmark = b.id ORDER BY v.visited DESC LIMIT 10)),
+  CASE
+    WHEN julianday('now') - julianday(b.lastAccess) <= 4 THEN 100
+    WHEN julianday('now') - julianday(b.lastAccess) <= 14 THEN 70
+    WHEN julianday('now') - julianday(b.lastAccess) <= 31 THEN 50
+    WHEN julianday('now') - julianday(b.lastAccess) <= 90 THEN 30
+    ELSE 10 END
+) AS score
+FROM bookmarks b;
+
+-- The score as of the last visit or refresh, so that ordering by it is cheap
+ALTER TABLE bookmarks ADD COLUMN frecency real NOT NULL DEFAULT 0;
+UPDATE bookmarks SET frecency = (SELECT score FROM frecency_scores WHERE bookmark = bookmarks.id);
+CREATE INDEX bookmarks_frecency ON bookmarks(owner, frecency);
+
+COMMIT;
+	`,
+	// version 14
+	`
+-- What opened the bookmark, if known
+ALTER TABLE visits ADD COLUMN client text;
+ALTER TABLE visits ADD COLUMN userAgent text;
+
+CREATE INDEX visits_visited ON visits(visited);
+	`,
+	// version 15
+	`
+BEGIN;
+
+-- What came of the last request for each bookmark's url. The status is 0 if
+-- there was no response at all, with the reason in error.
+CREATE TABLE link_checks (
+  bookmark integer primary key,
+  checked datetime NOT NULL,
+  status integer NOT NULL,
+  error text,
+  redirectUrl text,
+  permanent integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX link_checks_checked ON link_checks(checked);
+
+CREATE TRIGGER bookmarks_link_checks_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM link_checks WHERE bookmark = old.id;
+END;
+
+-- a new url needs checking afresh
+CREATE TRIGGER bookmarks_link_checks_au AFTER UPDATE OF url ON bookmarks WHEN new.url IS NOT old.url BEGIN
+  DELETE FROM link_checks WHERE bookmark = old.id;
+END;
+
+COMMIT;
+	`,
+	// version 16
+	`
+BEGIN;
+
+-- Other urls that find a bookmark, such as the one it was added as before
+-- moving to the page's canonical url, or those of bookmarks merged into it
+CREATE TABLE aliases (
+  id integer primary key,
+  owner integer NOT NULL REFERENCES users(id),
+  url text NOT NULL,
+  bookmark integer NOT NULL,
+  UNIQUE (owner, url)
+);
+
+CREATE INDEX aliases_bookmark ON aliases(bookmark);
+
+CREATE TRIGGER bookmarks_aliases_ad AFTER DELETE ON bookmarks BEGIN
+  DELETE FROM aliases WHERE bookmark = old.id;
+END;
+
+-- Whether the bookmark should move to the canonical url of the page once
+-- it is fetched
+ALTER TABLE jobs ADD COLUMN canonical integer NOT NULL DEFAULT 0;
+
+COMMIT;
+	`,
+	// version 17
+	`
+BEGIN;
+
+-- The words of the url are worked out by the server as urls are written,
+-- rather than by a tangle of sql, and filled in for the bookmarks already
+-- there once the schema is up to date. The column can't be dropped while the
+-- triggers refer to it, so they are made again.
+DROP TRIGGER bookmarks_ai;
+DROP TRIGGER bookmarks_ad;
+DROP TRIGGER bookmarks_au;
+
+ALTER TABLE bookmarks DROP COLUMN urlWords;
+ALTER TABLE bookmarks ADD COLUMN urlWords text;
+
+CREATE TRIGGER bookmarks_ai AFTER INSERT ON bookmarks BEGIN
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes, urlWords) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes, new.urlWords);
+END;
+
+CREATE TRIGGER bookmarks_ad AFTER DELETE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes, urlWords) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes, old.urlWords);
+END;
+
+CREATE TRIGGER bookmarks_au AFTER UPDATE ON bookmarks BEGIN
+  INSERT INTO fts(fts, rowid, url, title, favorite, tags, notes, urlWords) VALUES('delete', old.id, old.url, old.title, old.favorite, old.tags, old.notes, old.urlWords);
+  INSERT INTO fts(rowid, url, title, favorite, tags, notes, urlWords) VALUES (new.id, new.url, new.title, new.favorite, new.tags, new.notes, new.urlWords);
+END;
+
+COMMIT;
+	`,
 }
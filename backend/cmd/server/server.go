@@ -1,35 +1,162 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/netip"
+	"os"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
 
 type specification struct {
-	Port         int    `default:"9000"`
-	FrontendPath string `default:"/home/richard/src/bookmark/frontend/dist"`
-	DbFile       string `default:"/home/richard/src/bookmarks/data/bookmark.db"`
+	Port              int           `default:"9000"`
+	FrontendPath      string        `default:"/home/richard/src/bookmark/frontend/dist"`
+	DbFile            string        `default:"/home/richard/src/bookmarks/data/bookmark.db"`
+	FetchTimeout      time.Duration `default:"30s"`
+	FetchMaxBodyBytes int64         `default:"5242880"`
+	FetchMaxRedirects int           `default:"10"`
+	FetchWorkers      int           `default:"2"`
+	FetchAttempts     int           `default:"5"`
+	FetchRetryDelay   time.Duration `default:"30s"`
+	// CIDR ranges on the local network that bookmarks may point into
+	FetchAllowedNetworks []string
+	// Secret for the Pinboard-compatible api, which refuses every request
+	// while this is empty
+	PinboardToken string
+	// Any of "basic", "token" and "proxy"; with none, there is no
+	// authentication at all
+	Auth []string
+	// For basic, a file of user:bcrypt-hash lines as written by htpasswd -B
+	AuthHtpasswdFile string
+	// For proxy, the header holding the user name, and the CIDR ranges of
+	// the proxies trusted to set it
+	AuthProxyHeader    string `default:"X-Forwarded-User"`
+	AuthTrustedProxies []string
+	// How often to work out frecency scores afresh as visits age
+	FrecencyRefreshInterval time.Duration `default:"24h"`
+	// Whether to check now and then that bookmarked urls still work, how
+	// often to check each one, and how many checks to run at once, overall
+	// and against any one host
+	LinkCheck         bool          `default:"true"`
+	LinkCheckInterval time.Duration `default:"168h"`
+	LinkCheckWorkers  int           `default:"4"`
+	LinkCheckPerHost  int           `default:"1"`
+	// Query parameters stripped from urls as they are added, with a
+	// trailing * matching any parameter starting with what comes before;
+	// with none, defaultTrackingParams
+	TrackingParams []string
 }
 
 var spec specification
 
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// How often frecency scores are refreshed when no interval is configured
+const defaultFrecencyRefreshInterval = 24 * time.Hour
+
+// Refreshes the frecency scores straight away and then every interval, or
+// every day if the interval isn't positive, until the context is done
+func refreshFrecency(ctx context.Context, db Db, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultFrecencyRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := db.RefreshFrecency(ctx)
+		if err != nil {
+			log.Printf("Error refreshing frecency: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func main() {
 	err := envconfig.Process("bookmarkserver", &spec)
 	if err != nil {
 		log.Fatal("error reading environment variables:", err)
 	}
 
-	db, err := NewDb(spec.DbFile)
+	db, err := NewDb(spec.DbFile, NewUrlNormalizer(spec.TrackingParams))
 	if err != nil {
 		log.Fatal("error initializing database interface:", err)
 	}
 	defer db.Close()
 
-	fetcher, err := NewFetcher()
+	if len(os.Args) > 1 {
+		err = runCommand(context.Background(), db, os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	allowedNetworks, err := parsePrefixes(spec.FetchAllowedNetworks)
+	if err != nil {
+		log.Fatal("error parsing allowed network:", err)
+	}
+	trustedProxies, err := parsePrefixes(spec.AuthTrustedProxies)
+	if err != nil {
+		log.Fatal("error parsing trusted proxy:", err)
+	}
+	authenticators, err := newAuthenticators(db, AuthConfig{
+		Methods:        spec.Auth,
+		HtpasswdFile:   spec.AuthHtpasswdFile,
+		ProxyHeader:    spec.AuthProxyHeader,
+		TrustedProxies: trustedProxies,
+	})
+	if err != nil {
+		log.Fatal("error setting up authentication:", err)
+	}
+	if len(authenticators) == 0 {
+		log.Println("warning: authentication is off, so anyone who can reach the server can use it")
+	}
+
+	fetcher, err := NewFetcher(FetcherConfig{
+		Timeout:         spec.FetchTimeout,
+		MaxBodyBytes:    spec.FetchMaxBodyBytes,
+		MaxRedirects:    spec.FetchMaxRedirects,
+		AllowedNetworks: allowedNetworks,
+	})
 	if err != nil {
 		log.Fatal("error initializing fetcher:", err)
 	}
 
-	handler(db, fetcher, spec.Port, spec.FrontendPath)
+	queue := NewJobQueue(db, fetcher, JobQueueConfig{
+		Workers:     spec.FetchWorkers,
+		MaxAttempts: spec.FetchAttempts,
+		RetryDelay:  spec.FetchRetryDelay,
+	})
+	err = queue.Start(context.Background())
+	if err != nil {
+		log.Fatal("error starting fetch queue:", err)
+	}
+
+	go refreshFrecency(context.Background(), db, spec.FrecencyRefreshInterval)
+
+	if spec.LinkCheck {
+		NewLinkChecker(db, fetcher, LinkCheckerConfig{
+			Interval: spec.LinkCheckInterval,
+			Workers:  spec.LinkCheckWorkers,
+			PerHost:  spec.LinkCheckPerHost,
+		}).Start(context.Background())
+	}
+
+	handler(db, fetcher, queue, spec.Port, spec.FrontendPath, spec.PinboardToken, authenticators)
 }
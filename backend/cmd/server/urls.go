@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Query parameters that only serve to track where a visitor came from, and
+// so are stripped from urls unless configured otherwise. A trailing * matches
+// any parameter that starts with what comes before it.
+var defaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid",
+	"mc_cid", "mc_eid", "igshid", "_hsenc", "_hsmi", "mkt_tok",
+}
+
+// Puts urls into a standard form, so that the different ways of writing a
+// url all find the same bookmark
+type UrlNormalizer struct {
+	trackingParams []string
+}
+
+// Returns a normalizer that strips the given tracking parameters, or the
+// default ones if there are none
+func NewUrlNormalizer(trackingParams []string) *UrlNormalizer {
+	if len(trackingParams) == 0 {
+		trackingParams = defaultTrackingParams
+	}
+	return &UrlNormalizer{trackingParams}
+}
+
+func (normalizer *UrlNormalizer) isTracking(param string) bool {
+	for _, tracking := range normalizer.trackingParams {
+		prefix, wildcard := strings.CutSuffix(tracking, "*")
+		if param == tracking || (wildcard && strings.HasPrefix(param, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the normal form of a web url: the scheme and host in lower case,
+// without the default port, tracking parameters or a trailing slash. The
+// fragment is dropped too, unless it looks like the route of a single page
+// app (#/path or #!path). Anything that isn't a web url is left alone.
+func (normalizer *UrlNormalizer) Normalize(rawUrl string) string {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return rawUrl
+	}
+	// url.Parse has already lower-cased the scheme
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "http" {
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	} else {
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	}
+
+	// the raw query is filtered rather than parsed and re-encoded, so that
+	// the parameters that are kept stay just as they were
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		name, err = url.QueryUnescape(name)
+		if param == "" || (err == nil && normalizer.isTracking(name)) {
+			continue
+		}
+		params = append(params, param)
+	}
+	u.RawQuery = strings.Join(params, "&")
+	u.ForceQuery = false
+
+	if !strings.HasPrefix(u.Fragment, "/") && !strings.HasPrefix(u.Fragment, "!") {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String()
+}
+
+// Returns what urls for the same page have in common: their normal form,
+// without the scheme or any leading www.
+func (normalizer *UrlNormalizer) duplicateKey(rawUrl string) string {
+	normal := normalizer.Normalize(rawUrl)
+	u, err := url.Parse(normal)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return normal
+	}
+	u.Scheme = ""
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	return strings.TrimPrefix(u.String(), "//")
+}
+
+// Returns the words of a url worth searching for, which the full text index
+// splits on the punctuation: the host, without any www., and the path
+func urlWords(rawUrl string) string {
+	// the query and fragment are mostly ids and tracking
+	if i := strings.IndexAny(rawUrl, "?#"); i >= 0 {
+		rawUrl = rawUrl[:i]
+	}
+	// the scheme is the same for nearly everything, and a user name or
+	// password is nothing to search for
+	if _, rest, ok := strings.Cut(rawUrl, "://"); ok {
+		rawUrl = rest
+		host, _, _ := strings.Cut(rawUrl, "/")
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			rawUrl = rawUrl[i+1:]
+		}
+	}
+	// nor is www., though only at the start of the host
+	if len(rawUrl) >= 4 && strings.EqualFold(rawUrl[:4], "www.") {
+		rawUrl = rawUrl[4:]
+	}
+	return rawUrl
+}
@@ -5,7 +5,9 @@ go 1.24.2
 require (
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/crypto v0.37.0
 	golang.org/x/net v0.39.0
+	golang.org/x/text v0.24.0
 	gotest.tools v2.2.0+incompatible
 )
 
@@ -4,6 +4,31 @@ import { Toaster, toaster } from "@/components/ui/toaster"
 import axios from "axios";
 import { useQueryClient } from '@tanstack/react-query';
 
+// The fetch of a newly added bookmark, as /api/add and /api/job describe it
+type Job = {
+    id: number;
+    state: "queued" | "running" | "done" | "failed";
+    lastError: string;
+}
+
+const jobPollInterval = 1000;
+// failed fetches are retried after a while, which isn't worth waiting for
+const jobPollLimit = 60;
+
+// Asks after a job until it has finished one way or the other, or has been
+// asked after often enough, returning how it was last seen
+const waitForJob = async (id: number): Promise<Job> => {
+    let job: Job | undefined;
+    for (let i = 0; i < jobPollLimit; i++) {
+        await new Promise((resolve) => setTimeout(resolve, jobPollInterval));
+        job = (await axios.get<Job>("/api/job?id=" + id)).data;
+        if (job.state === "done" || job.state === "failed") {
+            break;
+        }
+    }
+    return job!;
+}
+
 const AddBookmarkPage: React.FC = () => {
     const [url, setUrl] = useState("");
     const queryClient = useQueryClient();
@@ -19,10 +44,24 @@ const AddBookmarkPage: React.FC = () => {
               });
             return;
         }
-        const promise = axios.post("/api/add?url=" + encodeURIComponent(url)).then(
-            (_) => {
+        const promise = axios.post<Job>("/api/add?url=" + encodeURIComponent(url)).then(
+            (response) => {
                 queryClient.invalidateQueries({ queryKey: ['bookmarkList'] });
                 setUrl("");
+                // the bookmark is there already, but its title and the like
+                // turn up once the page has been fetched
+                if (response.status === 202 && response.data?.id) {
+                    waitForJob(response.data.id).then((job) => {
+                        queryClient.invalidateQueries({ queryKey: ['bookmarkList'] });
+                        if (job.state === "failed") {
+                            toaster.create({
+                                title: "Couldn't fetch the page",
+                                description: job.lastError,
+                                type: "error",
+                            });
+                        }
+                    }).catch((error) => console.log("Error waiting for job " + response.data.id + ": " + error));
+                }
             }
         );
         toaster.promise(promise, {
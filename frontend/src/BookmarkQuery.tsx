@@ -4,36 +4,70 @@
 // with the bookmark contents.
 import React from "react";
 import axios from "axios";
-import { useQuery, useQueryClient } from '@tanstack/react-query'
-import { HStack, VStack, Box } from "@chakra-ui/react"
+import { useInfiniteQuery, useQueryClient } from '@tanstack/react-query'
+import { HStack, VStack, Box, Button } from "@chakra-ui/react"
 import { LuStar } from "react-icons/lu";
 
+// Text with the parts that matched a search marked, as offsets into the text
+type HighlightedText = {
+  text: string;
+  matches: Array<{ start: number; end: number }>;
+}
+
 type BookmarkEntry = {
   title: string;
   url: string;
   isFavorite: boolean;
+  titleHighlight?: HighlightedText;
+  snippet?: HighlightedText;
+}
+
+// A page of bookmarks, and how to ask for the next one
+type BookmarkPage = {
+  items: Array<BookmarkEntry>;
+  nextCursor: string;
+  total: number;
+}
+
+const Highlighted: React.FC<{ value: HighlightedText }> = ({ value }) => {
+  const parts: React.ReactNode[] = [];
+  let pos = 0;
+  value.matches.forEach((match, i) => {
+    parts.push(value.text.slice(pos, match.start));
+    parts.push(<mark key={i}>{value.text.slice(match.start, match.end)}</mark>);
+    pos = match.end;
+  });
+  parts.push(value.text.slice(pos));
+  return <>{parts}</>;
 }
 
 interface Props {
   queryPath: string;
+  // For results that don't come in pages, asks for more of them at once
+  onMore?: () => void;
 }
 
-const BookmarkQuery: React.FC<Props> = ({ queryPath }: Props) => {
+const BookmarkQuery: React.FC<Props> = ({ queryPath, onMore }: Props) => {
   const queryClient = useQueryClient();
 
   const fetchQuery = (queryPath: string) => {
-    return async () => {
-      console.log("fetching " + queryPath);
-      const response = await axios.get<Array<BookmarkEntry>>(queryPath);
+    return async ({ pageParam }: { pageParam: string }) => {
+      const path = pageParam ? queryPath + "&cursor=" + encodeURIComponent(pageParam) : queryPath;
+      console.log("fetching " + path);
+      const response = await axios.get<BookmarkPage>(path);
       return response.data;
     };
   };
 
-  const { isError, data, error } = useQuery({
+  const { isError, data, error, hasNextPage, fetchNextPage, isFetchingNextPage } = useInfiniteQuery({
     queryKey: ['bookmarkList', queryPath],
     queryFn: fetchQuery(queryPath),
+    initialPageParam: "",
+    getNextPageParam: (lastPage) => lastPage.nextCursor || undefined,
   });
-  const recents = data;
+  const recents = data?.pages.flatMap((page) => page.items);
+  const total = data?.pages[0]?.total ?? 0;
+  const hasMore = !!onMore && !hasNextPage && recents !== undefined && recents.length < total;
 
   const handleBookmarkClick = (url: string) => {
     return () => {
@@ -55,6 +89,10 @@ const BookmarkQuery: React.FC<Props> = ({ queryPath }: Props) => {
   }
 
   if (isError) {
+    // malformed searches come back with an explanation
+    if (axios.isAxiosError(error) && error.response?.data?.error) {
+      return <div>Can't search for that: {error.response.data.error}</div>
+    }
     return <div>An error occurred: {error.message}</div>
   }
 
@@ -67,12 +105,17 @@ const BookmarkQuery: React.FC<Props> = ({ queryPath }: Props) => {
           </Box>
           <VStack align="left" spaceY={0} >
             <div className="bookmarkEntry" key={recent.url} onClick={handleBookmarkClick(recent.url)}>
-              <div className="title">{recent.title}</div>
+              <div className="title">{recent.titleHighlight ? <Highlighted value={recent.titleHighlight} /> : recent.title}</div>
+              {recent.snippet && <div className="snippet"><Highlighted value={recent.snippet} /></div>}
               <div className="url">{new URL(recent.url).hostname}</div>
             </div>
           </VStack>
         </HStack>
       )}
+      {hasNextPage &&
+        <Button variant="ghost" onClick={() => fetchNextPage()} disabled={isFetchingNextPage}>More</Button>}
+      {hasMore &&
+        <Button variant="ghost" onClick={onMore}>More</Button>}
     </div>
   );
 };
@@ -3,13 +3,19 @@ import { Input } from '@chakra-ui/react';
 
 import BookmarkQuery from "./BookmarkQuery.tsx";
 
+const pageSize = 50;
+
 const SearchPage: React.FC = () => {
   const [searchQuery, setSearchQuery] = useState("");
   const [debouncedQuery, setDebouncedQuery] = useState("");
+  // search results in order of relevance come in a single page, so More asks
+  // for a bigger one
+  const [count, setCount] = useState(pageSize);
 
   useEffect(() => {
     const timer = setTimeout(() => {
       setDebouncedQuery(searchQuery);
+      setCount(pageSize);
     }, 500);
 
     return () => clearTimeout(timer);
@@ -23,7 +29,11 @@ const SearchPage: React.FC = () => {
         onChange={(e) => setSearchQuery(e.target.value)}
         mb={4}
       />
-      {debouncedQuery && <BookmarkQuery queryPath={"/api/search?q=" + encodeURIComponent(debouncedQuery)} />}
+      {debouncedQuery &&
+        <BookmarkQuery
+          queryPath={"/api/search?q=" + encodeURIComponent(debouncedQuery) + "&count=" + count}
+          onMore={() => setCount(count + pageSize)}
+        />}
     </div>
   );
 };